@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"shareit/db"
+	"shareit/files"
+	"strconv"
+)
+
+// DeleteFile permanently deletes any file (?file_id=), bypassing permissions and the trash, e.g.
+// for abusive content
+func DeleteFile(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, err := strconv.Atoi(r.URL.Query().Get("file_id"))
+	if err != nil {
+		http.Error(w, "file_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var ownerID int
+	var filename string
+	err = db.DB.QueryRow("SELECT user_id, filename FROM files WHERE id = ?", fileID).Scan(&ownerID, &filename)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = files.RemoveFile(r.Context(), fileID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error deleting file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %d deleted file %d (%q) of user %d", userID, fileID, filename, ownerID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File deleted successfully"})
+}
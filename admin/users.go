@@ -0,0 +1,272 @@
+package admin
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"shareit/auth"
+	"shareit/db"
+	"shareit/files"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User is an account as the admin API shows it
+type User struct {
+	ID          int        `json:"id"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	Verified    bool       `json:"verified"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	SuspendedAt *time.Time `json:"suspended_at"`
+	UsedBytes   int64      `json:"used_bytes"`
+	UsedFiles   int64      `json:"used_files"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// userIDParam reads ?user_id= and checks that the user exists
+func userIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return 0, false
+	}
+	var exists bool
+	if err := db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	return userID, true
+}
+
+// ListUsers lists accounts, optionally searched by email (?q=) and filtered by role and status
+// (active or suspended), with limit/offset paging
+func ListUsers(w http.ResponseWriter, r *http.Request, userID int) {
+	q := r.URL.Query()
+	query := `SELECT id, email, role, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, suspended_at,
+		used_bytes, used_files, created_at FROM users WHERE 1 = 1`
+	args := []interface{}{}
+	if search := q.Get("q"); search != "" {
+		query += ` AND email LIKE ? ESCAPE '\\'`
+		args = append(args, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search)+"%")
+	}
+	if role := q.Get("role"); role != "" {
+		if !auth.ValidRole(role) {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		query += " AND role = ?"
+		args = append(args, role)
+	}
+	switch q.Get("status") {
+	case "":
+	case "active":
+		query += " AND suspended_at IS NULL"
+	case "suspended":
+		query += " AND suspended_at IS NOT NULL"
+	default:
+		http.Error(w, "status must be active or suspended", http.StatusBadRequest)
+		return
+	}
+
+	limit, offset := 50, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must not be negative", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	query += " ORDER BY id LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		log.Println("Error retrieving users:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		var suspendedAt sql.NullString
+		var createdAtStr string
+		if err := rows.Scan(&u.ID, &u.Email, &u.Role, &u.Verified, &u.MFAEnabled, &suspendedAt,
+			&u.UsedBytes, &u.UsedFiles, &createdAtStr); err != nil {
+			log.Println("Error scanning user:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if suspendedAt.Valid {
+			t, _ := time.Parse("2006-01-02 15:04:05", suspendedAt.String)
+			u.SuspendedAt = &t
+		}
+		u.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		users = append(users, u)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+// GetUserUsage shows the storage usage and quotas of any user (?user_id=)
+func GetUserUsage(w http.ResponseWriter, r *http.Request, userID int) {
+	targetID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	files.GetUsage(w, r, targetID)
+}
+
+// SuspendUser blocks an account (?user_id=): it is logged out everywhere, and neither its logins
+// nor its personal access tokens work until it is reactivated
+func SuspendUser(w http.ResponseWriter, r *http.Request, userID int) {
+	targetID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	if targetID == userID {
+		http.Error(w, "You cannot suspend yourself", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.DB.Exec("UPDATE users SET suspended_at = ? WHERE id = ? AND suspended_at IS NULL", time.Now(), targetID)
+	if err != nil {
+		log.Println("Error suspending user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := auth.RevokeAllSessions(r.Context(), targetID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %d suspended user %d", userID, targetID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User suspended successfully"})
+}
+
+// ReactivateUser lifts the suspension of an account (?user_id=)
+func ReactivateUser(w http.ResponseWriter, r *http.Request, userID int) {
+	targetID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE users SET suspended_at = NULL WHERE id = ?", targetID); err != nil {
+		log.Println("Error reactivating user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %d reactivated user %d", userID, targetID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User reactivated successfully"})
+}
+
+// SetUserRole changes the role of an account
+func SetUserRole(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		UserID int    `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 || !auth.ValidRole(req.Role) {
+		http.Error(w, "user_id and role (user, admin or auditor) are required", http.StatusBadRequest)
+		return
+	}
+	// Keeps the last admin from locking everyone out
+	if req.UserID == userID {
+		http.Error(w, "You cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, req.UserID)
+	if err != nil {
+		log.Println("Error updating role:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", req.UserID).Scan(&exists)
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+	log.Printf("Admin %d set the role of user %d to %s", userID, req.UserID, req.Role)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated successfully"})
+}
+
+// ResetUserPassword locks a possibly compromised account (?user_id=): its password is replaced by
+// a random one nobody knows, every session is logged out, and the user gets a password reset mail.
+// Admins never see or choose the new password.
+func ResetUserPassword(w http.ResponseWriter, r *http.Request, userID int) {
+	targetID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var email string
+	if err := db.DB.QueryRow("SELECT email FROM users WHERE id = ?", targetID).Scan(&email); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		log.Println("Error generating password:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	password, err := bcrypt.GenerateFromPassword(raw, bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.DB.Exec("UPDATE users SET password = ? WHERE id = ?", password, targetID); err != nil {
+		log.Println("Error updating password:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := auth.RevokeAllCredentials(r.Context(), targetID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Admin %d reset the password of user %d", userID, targetID)
+
+	if err := auth.SendPasswordReset(r.Context(), targetID, email); err != nil {
+		log.Println(err)
+		http.Error(w, "The password was reset, but the reset email could not be sent", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset; the user was sent a password reset email"})
+}
@@ -1,14 +1,18 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/mail"
 	"shareit/db"
 	"shareit/rate_limiter"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -19,13 +23,30 @@ type User struct {
 	Password string `json:"password"`
 }
 
-// SignupHandler handles user registration
+// redisError logs err from a Redis command and answers 503 while Redis is unavailable, so that the
+// client retries later, or 500 for other errors
+func redisError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	if db.Unavailable(err) {
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// SignupHandler handles user registration. The account starts unverified; a verification link is
+// mailed to the address.
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
+	addr, err := mail.ParseAddress(user.Email)
+	if err != nil || addr.Address != user.Email || user.Password == "" {
+		http.Error(w, "A valid email address and a password are required", http.StatusBadRequest)
+		return
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -33,17 +54,33 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.DB.Exec("INSERT INTO users (email, password) VALUES (?, ?)", user.Email, hashedPassword)
+	result, err := db.DB.Exec("INSERT INTO users (email, password) VALUES (?, ?)", user.Email, hashedPassword)
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		log.Println("Error retrieving user id:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Counts against the resend throttle, so the first resend cannot follow immediately
+	if _, err := resendAllowed(r.Context(), user.Email); err != nil {
+		log.Println("Error setting verification throttle:", err)
+	}
+	go func() {
+		if err := sendVerification(context.Background(), int(userID), user.Email); err != nil {
+			log.Println(err)
+		}
+	}()
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully, check your email to verify your address"})
 }
 
-// LoginHandler handles user login and issues JWT token
+// LoginHandler handles user login and issues an access token and a refresh token
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var user User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -51,9 +88,26 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Repeated failures for the account or from the address make every further attempt wait
+	ip := rate_limiter.ClientIP(r)
+	wait, err := loginLocked(r.Context(), user.Email, ip)
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
 	var storedUser User
-	err := db.DB.QueryRow("SELECT id, email, password FROM users WHERE email = ?", user.Email).Scan(&storedUser.ID, &storedUser.Email, &storedUser.Password)
+	var mfaEnabled bool
+	err = db.DB.QueryRow("SELECT id, email, password, totp_enabled_at IS NOT NULL FROM users WHERE email = ?", user.Email).
+		Scan(&storedUser.ID, &storedUser.Email, &storedUser.Password, &mfaEnabled)
 	if err == sql.ErrNoRows {
+		recordLoginFailure(r.Context(), user.Email, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	} else if err != nil {
@@ -64,61 +118,141 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password))
 	if err != nil {
+		recordLoginFailure(r.Context(), user.Email, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := GenerateJWT(storedUser.Email)
+	allowed, err := passwordLoginAllowed(r.Context(), storedUser.ID)
 	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "This account logs in with single sign-on at /login/oidc", http.StatusForbidden)
+		return
+	}
+
+	// With two-factor authentication the password only earns a challenge for /login/mfa
+	if mfaEnabled {
+		challenge, err := beginMFAChallenge(r.Context(), storedUser.ID)
+		if err != nil {
+			redisError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	// With the password the login is complete; a second factor clears the failures in /login/mfa
+	clearLoginFailures(r.Context(), storedUser.Email)
+
+	// A login starts a new refresh token family
+	tokens, err := issueTokens(r, storedUser.ID, storedUser.Email, "")
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println(err)
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(tokens)
 }
 
-// RequireAuth middleware to authenticate users using JWT and pass userID to handlers
-func RequireAuth(next func(w http.ResponseWriter, r *http.Request, userID int)) http.HandlerFunc {
+// RequireAuth middleware to authenticate users using JWT and pass userID to handlers. Personal
+// access tokens are accepted as well if they carry every one of scopes; routes without scopes only
+// accept access tokens from a login.
+func RequireAuth(next func(w http.ResponseWriter, r *http.Request, userID int), scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
 			return
 		}
-
-		tokenString := authHeader[len("Bearer "):]
-		claims := &Claims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
+		tokenString, found := strings.CutPrefix(authHeader, "Bearer ")
+		if !found {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
 		}
 
-		// Extract the email from the claims
-		email := claims.Email
+		ctx := r.Context()
+		var acct account
+		if strings.HasPrefix(tokenString, patPrefix) {
+			pat, userID, err := authenticatePAT(ctx, tokenString)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if pat == nil {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			if !pat.hasScopes(scopes) {
+				http.Error(w, "Token does not have the scope required for this endpoint", http.StatusForbidden)
+				return
+			}
+			acct, err = loadAccount(ctx, "id = ?", userID)
+			if err != nil {
+				log.Println("Error retrieving user:", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			ctx = context.WithValue(ctx, patKey{}, pat)
+		} else {
+			claims, ok := ValidateJWT(tokenString)
+			if !ok {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+
+			// Tokens of logged out sessions and of revoked token families are on the revocation list
+			revoked, err := isRevoked(ctx, claims)
+			if err != nil && !db.FailsOpen(db.FeatureRevocation, err) {
+				log.Println("Error checking token revocation:", err)
+				http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if revoked {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			touchSession(r, claims.Family)
 
-		// Query to get user ID based on email
-		var userID int
-		err = db.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusUnauthorized)
+			// Query to get the user based on email
+			acct, err = loadAccount(ctx, "email = ?", claims.Email)
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				log.Println("Error retrieving user:", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			ctx = context.WithValue(ctx, claimsKey{}, claims)
+		}
+		userID := acct.ID
+
+		if acct.Suspended {
+			http.Error(w, "Account suspended", http.StatusForbidden)
 			return
-		} else if err != nil {
-			log.Println("Error retrieving user:", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		if !acct.Verified && unverifiedPolicy == unverifiedBlock {
+			http.Error(w, "Verify your email address first", http.StatusForbidden)
 			return
 		}
 
-		// Apply rate limiting
-		if !rate_limiter.RateLimit(userID) {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		// Apply the rate limit policy of the route
+		if !rate_limiter.Allow(w, r, "user:"+strconv.Itoa(userID)) {
 			return
 		}
-		// Call the next handler, passing userID
-		next(w, r, userID)
+		// Call the next handler, passing userID, the token claims (or personal access token), the
+		// verification state and the role in the request context
+		ctx = context.WithValue(ctx, verifiedKey{}, acct.Verified)
+		ctx = context.WithValue(ctx, roleKey{}, acct.Role)
+		next(w, r.WithContext(ctx), userID)
 	}
 }
@@ -6,22 +6,34 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// Define your JWT secret key (preferably load from environment variables in production)
-var jwtSecret = []byte("my_secret_key")
+// jwtSecret signs the access tokens (JWT_SECRET), set by InitTokens
+var jwtSecret []byte
 
 // Claims struct to represent JWT claims
 type Claims struct {
 	Email string `json:"email"`
+	// Family is the refresh token family the access token was issued with; revoking the family
+	// (logout, refresh token reuse) revokes the access token as well
+	Family string `json:"fam,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateJWT generates a JWT token for the authenticated user
-func GenerateJWT(email string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
+// GenerateJWT generates a short-lived access token for the authenticated user. Every token gets a
+// unique ID (jti) so it can be revoked on its own.
+func GenerateJWT(email, family string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
 	claims := &Claims{
 		Email: email,
+		Family: family,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
 		},
 	}
 
@@ -30,12 +42,13 @@ func GenerateJWT(email string) (string, error) {
 	return tokenString, err
 }
 
-// ValidateJWT validates the provided JWT token
+// ValidateJWT validates the signature and expiry of the provided JWT token. Revocation is checked
+// separately by RequireAuth.
 func ValidateJWT(tokenString string) (*Claims, bool) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil || !token.Valid {
 		return nil, false
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"shareit/config"
+	"shareit/db"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// loginFailureWindow is how long failed logins are remembered after the last one
+	loginFailureWindow = time.Hour
+	// loginBackoffBase is the delay after the first failure beyond the free attempts; every further
+	// failure doubles it
+	loginBackoffBase = time.Second
+)
+
+var (
+	// loginMaxAttempts is how many failed logins an account may have before backoff starts
+	// (LOGIN_MAX_ATTEMPTS)
+	loginMaxAttempts = 5
+	// loginIPMaxAttempts is the same per client IP address, higher because offices and mobile
+	// networks share addresses (LOGIN_IP_MAX_ATTEMPTS)
+	loginIPMaxAttempts = 20
+	// loginLockoutMax caps the backoff; at the cap the account or address is locked out for that
+	// long after every further failure (LOGIN_LOCKOUT_MAX)
+	loginLockoutMax = 15 * time.Minute
+)
+
+// InitLoginThrottling takes the free attempts per account and per address and the longest lockout
+// from cfg
+func InitLoginThrottling(cfg *config.Config) {
+	loginMaxAttempts = cfg.LoginMaxAttempts
+	loginIPMaxAttempts = cfg.LoginIPMaxAttempts
+	loginLockoutMax = cfg.LoginLockoutMax
+}
+
+// Failed login counters and locks. Accounts are keyed by the hash of the submitted address, so
+// unknown addresses are throttled exactly like registered ones.
+func loginFailKey(subject string) string { return "login:fail:" + subject }
+func loginLockKey(subject string) string { return "login:lock:" + subject }
+
+func accountSubject(email string) string { return "acct:" + hashToken(strings.ToLower(email)) }
+func ipSubject(ip string) string         { return "ip:" + ip }
+
+// loginFailureScript counts a failure and, past the free attempts, locks the subject for an
+// exponentially growing time. It returns the lock in milliseconds (0 for none).
+var loginFailureScript = redis.NewScript(`
+local fails = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+local free = tonumber(ARGV[2])
+if fails <= free then return 0 end
+local delay = math.min(tonumber(ARGV[3]) * 2 ^ (fails - free - 1), tonumber(ARGV[4]))
+redis.call('SET', KEYS[2], 1, 'PX', math.floor(delay))
+return math.floor(delay)
+`)
+
+// loginBackoff is the lock after fails failures of a subject allowed free attempts, as computed
+// by loginFailureScript
+func loginBackoff(fails, free int) time.Duration {
+	if fails <= free {
+		return 0
+	}
+	delay := loginBackoffBase
+	for i := free + 1; i < fails && delay < loginLockoutMax; i++ {
+		delay *= 2
+	}
+	if delay > loginLockoutMax {
+		delay = loginLockoutMax
+	}
+	return delay
+}
+
+// maxLocalLockouts bounds the subjects the in-process lockout remembers
+const maxLocalLockouts = 100000
+
+// localLockout counts failed logins in process while Redis is unavailable. Each instance only
+// sees the failures it handled itself, so behind a load balancer an attacker gets the free
+// attempts once per instance, but the backoff still applies.
+type localLockout struct {
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	fails       int
+	expires     time.Time
+	lockedUntil time.Time
+}
+
+var localLockouts = &localLockout{entries: map[string]*lockoutEntry{}}
+
+// locked returns how long subject is locked out
+func (l *localLockout) locked(subject string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[subject]; ok && e.lockedUntil.After(now) {
+		return e.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail counts a failure of subject and returns the lock it caused
+func (l *localLockout) fail(subject string, free int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[subject]
+	if !ok || !e.expires.After(now) {
+		if len(l.entries) >= maxLocalLockouts {
+			l.sweep(now)
+		}
+		e = &lockoutEntry{}
+		l.entries[subject] = e
+	}
+	e.fails++
+	e.expires = now.Add(loginFailureWindow)
+	lock := loginBackoff(e.fails, free)
+	if lock > 0 {
+		e.lockedUntil = now.Add(lock)
+	}
+	return lock
+}
+
+func (l *localLockout) clear(subject string) {
+	l.mu.Lock()
+	delete(l.entries, subject)
+	l.mu.Unlock()
+}
+
+// sweep drops the subjects whose failures were forgotten. If the table is still full, unlocked
+// subjects whose last failure is more than half the window ago go too, since a full table must not
+// stop new failures from being counted.
+func (l *localLockout) sweep(now time.Time) {
+	for subject, e := range l.entries {
+		if !e.expires.After(now) {
+			delete(l.entries, subject)
+		}
+	}
+	if len(l.entries) < maxLocalLockouts {
+		return
+	}
+	cutoff := now.Add(loginFailureWindow / 2)
+	for subject, e := range l.entries {
+		if e.expires.Before(cutoff) && !e.lockedUntil.After(now) {
+			delete(l.entries, subject)
+		}
+	}
+}
+
+// loginLocked returns how long a login for email from ip has to wait, 0 if it may proceed. While
+// Redis is unavailable the in-process counters decide, unless lockout fails closed.
+func loginLocked(ctx context.Context, email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range []string{accountSubject(email), ipSubject(ip)} {
+		ttl, err := db.RedisClient.PTTL(ctx, loginLockKey(subject)).Result()
+		if db.FailsOpen(db.FeatureLockout, err) {
+			ttl, err = localLockouts.locked(subject, time.Now()), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login against the account and the client address
+func recordLoginFailure(ctx context.Context, email, ip string) {
+	subjects := []struct {
+		subject string
+		free    int
+	}{
+		{accountSubject(email), loginMaxAttempts},
+		{ipSubject(ip), loginIPMaxAttempts},
+	}
+	for _, s := range subjects {
+		lock, err := loginFailureScript.Run(ctx, db.RedisClient, []string{loginFailKey(s.subject), loginLockKey(s.subject)},
+			loginFailureWindow.Milliseconds(), s.free, loginBackoffBase.Milliseconds(), loginLockoutMax.Milliseconds()).Int64()
+		if db.FailsOpen(db.FeatureLockout, err) {
+			lock, err = localLockouts.fail(s.subject, s.free, time.Now()).Milliseconds(), nil
+		}
+		if err != nil {
+			log.Println("Error recording failed login:", err)
+			continue
+		}
+		if time.Duration(lock)*time.Millisecond >= loginLockoutMax {
+			log.Printf("Login locked out for %s after repeated failures", s.subject)
+		}
+	}
+}
+
+// clearLoginFailures forgets the failed logins of an account after it logged in. The counter of the
+// address stays, or an attacker could reset it by logging into an account of their own.
+func clearLoginFailures(ctx context.Context, email string) {
+	subject := accountSubject(email)
+	localLockouts.clear(subject)
+	if err := db.RedisClient.Del(ctx, loginFailKey(subject), loginLockKey(subject)).Err(); err != nil {
+		log.Println("Error clearing failed logins:", err)
+	}
+}
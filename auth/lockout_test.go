@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"shareit/db"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// withRedisDown points db.RedisClient at an address nothing listens on for the rest of the test
+func withRedisDown(t *testing.T) {
+	client := db.RedisClient
+	db.RedisClient = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		db.RedisClient.Close()
+		db.RedisClient = client
+	})
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		fails int
+		want  time.Duration
+	}{
+		{5, 0},
+		{6, time.Second},
+		{7, 2 * time.Second},
+		{9, 8 * time.Second},
+		{100, loginLockoutMax},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.fails, 5); got != tt.want {
+			t.Errorf("loginBackoff(%d, 5) = %v, want %v", tt.fails, got, tt.want)
+		}
+	}
+}
+
+func TestLocalLockout(t *testing.T) {
+	l := &localLockout{entries: map[string]*lockoutEntry{}}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if lock := l.fail("acct:a", 2, now); lock != 0 {
+			t.Fatalf("free attempt %d locked for %v", i+1, lock)
+		}
+	}
+	if lock := l.fail("acct:a", 2, now); lock != time.Second {
+		t.Fatalf("third failure locked for %v, want 1s", lock)
+	}
+	if wait := l.locked("acct:a", now.Add(500*time.Millisecond)); wait != 500*time.Millisecond {
+		t.Errorf("locked = %v halfway through the lock", wait)
+	}
+	if wait := l.locked("acct:b", now); wait != 0 {
+		t.Errorf("other subject locked for %v", wait)
+	}
+
+	// The failures are forgotten a window after the last one
+	later := now.Add(loginFailureWindow + time.Second)
+	if lock := l.fail("acct:a", 2, later); lock != 0 {
+		t.Errorf("failure after the window locked for %v", lock)
+	}
+	l.clear("acct:a")
+	if _, ok := l.entries["acct:a"]; ok {
+		t.Error("clear kept the subject")
+	}
+}
+
+func TestLoginLockoutWithoutRedis(t *testing.T) {
+	withRedisDown(t)
+	ctx := context.Background()
+	email, ip := "lockout-test@example.com", "192.0.2.1"
+	for i := 0; i <= loginMaxAttempts; i++ {
+		recordLoginFailure(ctx, email, ip)
+	}
+	wait, err := loginLocked(ctx, email, ip)
+	if err != nil {
+		t.Fatalf("loginLocked refused while Redis is down: %v", err)
+	}
+	if wait <= 0 {
+		t.Fatal("failures past the free attempts did not lock the account")
+	}
+
+	clearLoginFailures(ctx, email)
+	if wait, _ := loginLocked(ctx, email, ip); wait != 0 {
+		t.Errorf("still locked for %v after a successful login", wait)
+	}
+}
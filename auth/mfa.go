@@ -0,0 +1,586 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"shareit/config"
+	"shareit/db"
+	"shareit/encryption"
+	"shareit/rate_limiter"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// recoveryCodeCount is how many one-time recovery codes an account gets
+	recoveryCodeCount = 10
+	// mfaMaxAttempts is how many wrong codes one MFA challenge accepts before it is dropped
+	mfaMaxAttempts = 5
+)
+
+var (
+	// mfaIssuer names the service in authenticator apps (MFA_ISSUER)
+	mfaIssuer = "ShareIt"
+	// mfaChallengeTTL is how long the second login step can take (MFA_CHALLENGE_TTL)
+	mfaChallengeTTL = 5 * time.Minute
+)
+
+// InitMFA takes the issuer name and the challenge lifetime from cfg
+func InitMFA(cfg *config.Config) {
+	mfaIssuer = cfg.MFAIssuer
+	mfaChallengeTTL = cfg.MFAChallengeTTL
+}
+
+// mfaChallengeResponse is returned by login instead of tokens when the account has two-factor
+// authentication enabled; the token is exchanged for real tokens at /login/mfa
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// MFA challenges live in Redis, keyed by the hash of their token, next to a counter of failed codes
+func mfaChallengeKey(token string) string { return "mfa:challenge:" + hashToken(token) }
+func mfaAttemptsKey(token string) string  { return "mfa:attempts:" + hashToken(token) }
+
+// beginMFAChallenge records that userID passed the password step of a login
+func beginMFAChallenge(ctx context.Context, userID int) (mfaChallengeResponse, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return mfaChallengeResponse{}, err
+	}
+	if err := db.RedisClient.Set(ctx, mfaChallengeKey(token), userID, mfaChallengeTTL).Err(); err != nil {
+		return mfaChallengeResponse{}, fmt.Errorf("error saving MFA challenge: %w", err)
+	}
+	return mfaChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+	}, nil
+}
+
+// mfaFactor is the second factor a request presents: a TOTP code or a recovery code
+type mfaFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFALoginHandler completes a login with the MFA token from /login and a TOTP or recovery code
+func MFALoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		mfaFactor
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "mfa_token and code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	userID, err := db.RedisClient.Get(ctx, mfaChallengeKey(req.MFAToken)).Int()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		redisError(w, fmt.Errorf("error retrieving MFA challenge: %w", err))
+		return
+	}
+
+	var email string
+	if err := db.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := verifySecondFactor(ctx, userID, req.mfaFactor)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		// Wrong codes count as failed logins, so starting new challenges does not give more guesses
+		recordLoginFailure(ctx, email, rate_limiter.ClientIP(r))
+
+		// Too many wrong codes end the challenge; the password has to be entered again
+		attempts, err := db.RedisClient.Incr(ctx, mfaAttemptsKey(req.MFAToken)).Result()
+		if err != nil {
+			log.Println("Error counting MFA attempts:", err)
+		} else if attempts == 1 {
+			db.RedisClient.Expire(ctx, mfaAttemptsKey(req.MFAToken), mfaChallengeTTL)
+		}
+		if attempts >= mfaMaxAttempts {
+			db.RedisClient.Del(ctx, mfaChallengeKey(req.MFAToken), mfaAttemptsKey(req.MFAToken))
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	// The challenge works once; losing the race to a concurrent request means it was used already
+	n, err := db.RedisClient.Del(ctx, mfaChallengeKey(req.MFAToken), mfaAttemptsKey(req.MFAToken)).Result()
+	if err != nil {
+		redisError(w, fmt.Errorf("error removing MFA challenge: %w", err))
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	clearLoginFailures(ctx, email)
+
+	tokens, err := issueTokens(r, userID, email, "")
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// totpState is the TOTP configuration of an account. Secret is nil when none was enrolled.
+type totpState struct {
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+// loadTOTP reads and unwraps the TOTP secret of userID. Secrets are wrapped by the same key
+// provider as the data keys of files.
+func loadTOTP(ctx context.Context, userID int) (totpState, error) {
+	var state totpState
+	var wrapped []byte
+	var keyID sql.NullString
+	err := db.DB.QueryRowContext(ctx, `SELECT totp_secret, totp_key_id, totp_enabled_at IS NOT NULL, COALESCE(totp_last_step, 0)
+		FROM users WHERE id = ?`, userID).Scan(&wrapped, &keyID, &state.Enabled, &state.LastStep)
+	if err != nil {
+		return state, fmt.Errorf("error retrieving TOTP secret: %w", err)
+	}
+	if wrapped == nil {
+		state.Enabled = false
+		return state, nil
+	}
+	state.Secret, err = encryption.Keys.UnwrapKey(ctx, keyID.String, wrapped)
+	if err != nil {
+		return state, fmt.Errorf("error unwrapping TOTP secret: %w", err)
+	}
+	return state, nil
+}
+
+// useTOTP checks a TOTP code of an account with MFA enabled. Every code works once: the step it
+// belongs to is recorded, and codes of that step or earlier ones are rejected afterwards.
+func useTOTP(ctx context.Context, userID int, code string) (bool, error) {
+	state, err := loadTOTP(ctx, userID)
+	if err != nil || !state.Enabled {
+		return false, err
+	}
+	step, ok := matchTOTP(state.Secret, code, time.Now())
+	if !ok || step <= state.LastStep {
+		return false, nil
+	}
+	result, err := db.DB.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+		step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("error recording TOTP use: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// normalizeRecoveryCode accepts recovery codes with or without dashes, in any case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// useRecoveryCode spends one of the recovery codes of userID
+func useRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	result, err := db.DB.ExecContext(ctx, "UPDATE mfa_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// verifySecondFactor checks a TOTP code or, if one is given, a recovery code
+func verifySecondFactor(ctx context.Context, userID int, f mfaFactor) (bool, error) {
+	if f.RecoveryCode != "" {
+		return useRecoveryCode(ctx, userID, f.RecoveryCode)
+	}
+	if f.Code != "" {
+		return useTOTP(ctx, userID, f.Code)
+	}
+	return false, nil
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// replaceRecoveryCodes gives userID a fresh set of recovery codes; only their SHA-256 hashes are
+// stored (80 random bits each, so a fast hash is enough)
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+		_, err := tx.ExecContext(ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)",
+			userID, hashToken(code), time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("error saving recovery code: %w", err)
+		}
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+	}
+	return codes, nil
+}
+
+// MFAStatus reports whether two-factor authentication is enabled and how many recovery codes are left
+func MFAStatus(w http.ResponseWriter, r *http.Request, userID int) {
+	var enabled bool
+	var remaining int
+	err := db.DB.QueryRow(`SELECT u.totp_enabled_at IS NOT NULL,
+		(SELECT COUNT(*) FROM mfa_recovery_codes c WHERE c.user_id = u.id AND c.used_at IS NULL)
+		FROM users u WHERE u.id = ?`, userID).Scan(&enabled, &remaining)
+	if err != nil {
+		log.Println("Error retrieving MFA status:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollMFA starts TOTP enrollment: it creates a secret and returns it together with the otpauth://
+// URI for authenticator apps. MFA is enabled only once a code is confirmed with ConfirmMFA.
+func EnrollMFA(w http.ResponseWriter, r *http.Request, userID int) {
+	var email string
+	var enabled bool
+	err := db.DB.QueryRow("SELECT email, totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&email, &enabled)
+	if err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		log.Println("Error generating TOTP secret:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	wrapped, keyID, err := encryption.Keys.WrapKey(r.Context(), secret)
+	if err != nil {
+		log.Println("Error wrapping TOTP secret:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	result, err := db.DB.Exec("UPDATE users SET totp_secret = ?, totp_key_id = ?, totp_last_step = NULL WHERE id = ? AND totp_enabled_at IS NULL",
+		wrapped, keyID, userID)
+	if err != nil {
+		log.Println("Error saving TOTP secret:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      totpEncoding.EncodeToString(secret),
+		"otpauth_uri": totpURI(mfaIssuer, email, secret),
+	})
+}
+
+// ConfirmMFA enables two-factor authentication once the caller proves their authenticator app
+// produces valid codes, and returns the recovery codes. They are shown only here.
+func ConfirmMFA(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	state, err := loadTOTP(r.Context(), userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if state.Enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if state.Secret == nil {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+	step, ok := matchTOTP(state.Secret, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error enabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ? AND totp_enabled_at IS NULL",
+		time.Now(), step, userID)
+	if err != nil {
+		log.Println("Error enabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	codes, err := replaceRecoveryCodes(r.Context(), tx, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error enabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns two-factor authentication off. It takes the password and a TOTP or recovery
+// code, so a stolen access token alone cannot remove the second factor.
+func DisableMFA(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Password string `json:"password"`
+		mfaFactor
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "password and code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	var email, hashedPassword string
+	if err := db.DB.QueryRow("SELECT email, password FROM users WHERE id = ?", userID).Scan(&email, &hashedPassword); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Guesses here count as failed logins, so a stolen access token cannot brute force the password
+	ip := rate_limiter.ClientIP(r)
+	wait, err := loginLocked(r.Context(), email, ip)
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// One answer for a wrong password and a wrong code, so neither can be confirmed on its own
+	ok := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)) == nil
+	if ok {
+		ok, err = verifySecondFactor(r.Context(), userID, req.mfaFactor)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		recordLoginFailure(r.Context(), email, ip)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	clearLoginFailures(r.Context(), email)
+
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error disabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_secret = NULL, totp_key_id = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+		WHERE id = ?`, userID)
+	if err != nil {
+		log.Println("Error disabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		log.Println("Error deleting recovery codes:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error disabling MFA:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the caller, used or not, after checking a
+// TOTP code
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	var email string
+	if err := db.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// As for DisableMFA, wrong codes count as failed logins so the code cannot be brute forced
+	ip := rate_limiter.ClientIP(r)
+	wait, err := loginLocked(r.Context(), email, ip)
+	if err != nil {
+		log.Println("Error checking login lockout:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err := useTOTP(r.Context(), userID, req.Code)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		recordLoginFailure(r.Context(), email, ip)
+		http.Error(w, "Invalid code, or two-factor authentication is not enabled", http.StatusUnauthorized)
+		return
+	}
+	clearLoginFailures(r.Context(), email)
+
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error replacing recovery codes:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(r.Context(), tx, userID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error replacing recovery codes:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// RewrapTOTPSecrets moves every TOTP secret to the current master key version, so that older
+// versions can be retired after a rotation. It returns how many secrets were re-wrapped.
+func RewrapTOTPSecrets(ctx context.Context) (int, error) {
+	current, err := encryption.Keys.CurrentKeyID(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting current master key: %w", err)
+	}
+
+	rows, err := db.DB.QueryContext(ctx, "SELECT id, totp_secret, totp_key_id FROM users WHERE totp_secret IS NOT NULL AND totp_key_id <> ?", current)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving TOTP secrets: %w", err)
+	}
+	type secretRow struct {
+		userID  int
+		wrapped []byte
+		keyID   string
+	}
+	var secrets []secretRow
+	for rows.Next() {
+		var s secretRow
+		if err := rows.Scan(&s.userID, &s.wrapped, &s.keyID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error retrieving TOTP secrets: %w", err)
+		}
+		secrets = append(secrets, s)
+	}
+	rows.Close()
+
+	done := 0
+	for _, s := range secrets {
+		wrapped, keyID, err := encryption.RewrapKey(ctx, s.keyID, s.wrapped)
+		if err != nil {
+			return done, fmt.Errorf("error re-wrapping TOTP secret of user %d: %w", s.userID, err)
+		}
+		// Only replace the secret if the user did not re-enroll in the meantime
+		_, err = db.DB.ExecContext(ctx, "UPDATE users SET totp_secret = ?, totp_key_id = ? WHERE id = ? AND totp_key_id = ?",
+			wrapped, keyID, s.userID, s.keyID)
+		if err != nil {
+			return done, fmt.Errorf("error updating TOTP secret of user %d: %w", s.userID, err)
+		}
+		done++
+	}
+	return done, nil
+}
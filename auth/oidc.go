@@ -0,0 +1,643 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"shareit/config"
+	"shareit/db"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// oidcStateTTL is how long a user has to complete the login at the identity provider
+	oidcStateTTL = 10 * time.Minute
+	// jwksRefreshInterval limits how often an unknown key id makes us refetch the JWKS
+	jwksRefreshInterval = time.Minute
+	// oidcStateCookie holds a hash of the state in the browser that started the login
+	oidcStateCookie = "shareit_oidc_state"
+)
+
+// oidcProvider is the OpenID Connect identity provider configured with OIDC_ISSUER. It is nil when
+// single sign-on is not configured.
+type oidcProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+	// AutoProvision creates accounts for unknown identities (OIDC_AUTO_PROVISION)
+	AutoProvision bool
+	// LinkByEmail links an identity to the existing account with its email address, if the identity
+	// provider verified that address (OIDC_LINK_BY_EMAIL, off by default: it trusts the provider
+	// with every existing account)
+	LinkByEmail bool
+	// PasswordLogin allows accounts linked to an identity to log in with a password as well
+	// (OIDC_PASSWORD_LOGIN)
+	PasswordLogin bool
+
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+var oidc *oidcProvider
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// InitOIDC enables single sign-on when OIDC_ISSUER is set: it takes the client configuration from
+// cfg and reads the provider's discovery document. The redirect URL defaults to the callback under
+// PUBLIC_BASE_URL.
+func InitOIDC(cfg *config.Config) {
+	issuer := strings.TrimSuffix(cfg.OIDCIssuer, "/")
+	if issuer == "" {
+		return
+	}
+
+	p := &oidcProvider{
+		Issuer:        issuer,
+		ClientID:      cfg.OIDCClientID,
+		ClientSecret:  cfg.OIDCClientSecret,
+		RedirectURL:   cfg.OIDCRedirectURL,
+		Scopes:        cfg.OIDCScopes,
+		AutoProvision: cfg.OIDCAutoProvision,
+		LinkByEmail:   cfg.OIDCLinkByEmail,
+		PasswordLogin: cfg.OIDCPasswordLogin,
+	}
+	if p.RedirectURL == "" {
+		p.RedirectURL = cfg.PublicBaseURL + "/login/oidc/callback"
+	}
+	if err := p.discover(context.Background()); err != nil {
+		log.Fatal("Error reading OpenID Connect discovery document: ", err)
+	}
+	oidc = p
+	log.Println("Single sign-on through", issuer)
+}
+
+// discover reads the endpoints from the provider's /.well-known/openid-configuration
+func (p *oidcProvider) discover(ctx context.Context) error {
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+		return fmt.Errorf("discovery document is for issuer %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("discovery document lacks an endpoint")
+	}
+	p.Issuer = doc.Issuer
+	p.authorizationEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+	return nil
+}
+
+func getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the RSA key the provider signs ID tokens with under kid. The JWKS is cached and
+// refetched when an unknown key id shows up, which is how providers roll their keys.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key; tokens without a key id are accepted if the JWKS has only one key
+func (p *oidcProvider) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// idTokenClaims are the ID token claims a login needs
+type idTokenClaims struct {
+	Nonce           string `json:"nonce"`
+	Email           string `json:"email"`
+	EmailVerified   bool   `json:"email_verified"`
+	AuthorizedParty string `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("ID token is not meant for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("ID token was issued to another client")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// oidcState is kept in Redis between the redirect to the provider and the callback
+type oidcState struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	// LinkUserID is set when a logged-in user links their account instead of logging in
+	LinkUserID int `json:"link_user_id,omitempty"`
+}
+
+func oidcStateKey(state string) string { return "oidc:state:" + hashToken(state) }
+
+// setStateCookie binds state to the browser the flow starts in. The callback only accepts a state
+// whose hash matches the cookie, so a callback URL started by someone else (login CSRF, or an
+// attacker's identity being linked to the victim's account) is rejected. SameSite=Lax still sends
+// the cookie on the top-level redirect back from the identity provider.
+func (p *oidcProvider) setStateCookie(w http.ResponseWriter, state string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(state),
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if u, err := url.Parse(p.RedirectURL); err == nil {
+		cookie.Secure = u.Scheme == "https"
+		if u.Path != "" {
+			cookie.Path = u.Path
+		}
+	}
+	http.SetCookie(w, cookie)
+}
+
+// stateCookieMatches reports whether the state cookie of r holds the hash of state
+func stateCookieMatches(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(state))) == 1
+}
+
+// authorizationURL starts an authorization code flow with PKCE and returns where to send the user.
+// The flow only completes in a browser holding the state cookie it sets on w.
+func (p *oidcProvider) authorizationURL(ctx context.Context, w http.ResponseWriter, linkUserID int) (string, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	data, _ := json.Marshal(oidcState{Nonce: nonce, CodeVerifier: verifier, LinkUserID: linkUserID})
+	if err := db.RedisClient.Set(ctx, oidcStateKey(state), data, oidcStateTTL).Err(); err != nil {
+		return "", fmt.Errorf("error saving OIDC state: %w", err)
+	}
+	p.setStateCookie(w, state, int(oidcStateTTL/time.Second))
+
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", p.Scopes)
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authorizationEndpoint + sep + v.Encode(), nil
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the ID token
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, strings.TrimSpace(body.Error+" "+body.ErrorDescription))
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// OIDCLoginHandler sends the browser to the identity provider
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	location, err := oidc.authorizationURL(r.Context(), w, 0)
+	if err != nil {
+		redisError(w, err)
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// LinkOIDCAccount starts linking the caller's account to an identity at the identity provider. The
+// returned URL has to be opened in the browser that made this request, which receives the state
+// cookie; the callback then links instead of logging in.
+func LinkOIDCAccount(w http.ResponseWriter, r *http.Request, userID int) {
+	if oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	location, err := oidc.authorizationURL(r.Context(), w, userID)
+	if err != nil {
+		redisError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"authorization_url": location})
+}
+
+// Outcomes of a single sign-on login that are not an account
+var (
+	// errIdentityTaken is returned when an identity is already linked to another account
+	errIdentityTaken = errors.New("identity is linked to another account")
+	// errNoAccount is returned for unknown identities when provisioning is disabled
+	errNoAccount = errors.New("no account for identity")
+	// errEmailTaken is returned when the email address of an identity belongs to an account that
+	// cannot be linked automatically
+	errEmailTaken = errors.New("email address belongs to another account")
+)
+
+// OIDCCallbackHandler completes the authorization code flow: it validates the state, redeems the
+// code, verifies the ID token and then logs the user in (or links the identity)
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login was not completed: "+e, http.StatusUnauthorized)
+		return
+	}
+	stateParam, code := q.Get("state"), q.Get("code")
+	if stateParam == "" || code == "" {
+		http.Error(w, "state and code are required", http.StatusBadRequest)
+		return
+	}
+	// The state must have been issued to this browser
+	if !stateCookieMatches(r, stateParam) {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	oidc.setStateCookie(w, "", -1)
+
+	// Every state works once
+	ctx := r.Context()
+	data, err := db.RedisClient.GetDel(ctx, oidcStateKey(stateParam)).Bytes()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		redisError(w, fmt.Errorf("error retrieving OIDC state: %w", err))
+		return
+	}
+	var state oidcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("Error decoding OIDC state:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rawIDToken, err := oidc.exchangeCode(ctx, code, state.CodeVerifier)
+	if err != nil {
+		log.Println("Error redeeming authorization code:", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := oidc.verifyIDToken(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		log.Println("Invalid ID token:", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if state.LinkUserID != 0 {
+		err := linkIdentity(ctx, state.LinkUserID, claims)
+		if err == errIdentityTaken {
+			http.Error(w, "This identity is already linked to another account", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Account linked successfully"})
+		return
+	}
+
+	userID, email, err := resolveIdentity(ctx, claims)
+	if err == errNoAccount {
+		http.Error(w, "No account exists for this identity", http.StatusForbidden)
+		return
+	} else if err == errEmailTaken {
+		http.Error(w, "An account with this email address exists; log in with its password and link it at /account/oidc/link",
+			http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The identity provider stands in for the password only; accounts with two-factor authentication
+	// still need a code at /login/mfa
+	var mfaEnabled bool
+	if err := db.DB.QueryRowContext(ctx, "SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&mfaEnabled); err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		challenge, err := beginMFAChallenge(ctx, userID)
+		if err != nil {
+			redisError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	tokens, err := issueTokens(r, userID, email, "")
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// resolveIdentity finds the account of an identity: one linked before, one with the same verified
+// email address (which is linked on the way), or a new account
+func resolveIdentity(ctx context.Context, claims *idTokenClaims) (int, string, error) {
+	var userID int
+	var email string
+	err := db.DB.QueryRowContext(ctx, `SELECT u.id, u.email FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, claims.Issuer, claims.Subject).Scan(&userID, &email)
+	if err == nil {
+		_, err = db.DB.ExecContext(ctx, "UPDATE user_identities SET last_login_at = ? WHERE issuer = ? AND subject = ?",
+			time.Now(), claims.Issuer, claims.Subject)
+		if err != nil {
+			log.Println("Error updating identity:", err)
+		}
+		return userID, email, nil
+	} else if err != sql.ErrNoRows {
+		return 0, "", fmt.Errorf("error retrieving identity: %w", err)
+	}
+
+	if claims.Email == "" {
+		return 0, "", errNoAccount
+	}
+	err = db.DB.QueryRowContext(ctx, "SELECT id, email FROM users WHERE email = ?", claims.Email).Scan(&userID, &email)
+	if err == nil {
+		// An unverified address could be anyone's; only the owner of the account may link it then
+		if !claims.EmailVerified || !oidc.LinkByEmail {
+			return 0, "", errEmailTaken
+		}
+		if err := linkIdentity(ctx, userID, claims); err != nil {
+			return 0, "", err
+		}
+		return userID, email, nil
+	} else if err != sql.ErrNoRows {
+		return 0, "", fmt.Errorf("error fetching user: %w", err)
+	}
+
+	if !oidc.AutoProvision {
+		return 0, "", errNoAccount
+	}
+	userID, err = provisionUser(ctx, claims)
+	if err != nil {
+		return 0, "", err
+	}
+	return userID, claims.Email, nil
+}
+
+// provisionUser creates the account of a first-time single sign-on user. It gets a random password
+// nobody knows; a password reset can set one later.
+func provisionUser(ctx context.Context, claims *idTokenClaims) (int, error) {
+	password, err := randomToken(32)
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+	var verifiedAt *time.Time
+	if claims.EmailVerified {
+		now := time.Now()
+		verifiedAt = &now
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error provisioning user: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO users (email, password, email_verified_at) VALUES (?, ?, ?)",
+		claims.Email, hashedPassword, verifiedAt)
+	if err != nil {
+		return 0, fmt.Errorf("error provisioning user: %w", err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error provisioning user: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, userID, claims.Issuer, claims.Subject, claims.Email, time.Now(), time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error saving identity: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error provisioning user: %w", err)
+	}
+	log.Printf("Provisioned user %d for %s identity %s", userID, claims.Issuer, claims.Subject)
+	return int(userID), nil
+}
+
+// linkIdentity links an identity to userID. Linking the same identity again is a no-op; an identity
+// linked to another account gives errIdentityTaken.
+func linkIdentity(ctx context.Context, userID int, claims *idTokenClaims) error {
+	var linkedTo int
+	err := db.DB.QueryRowContext(ctx, "SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?",
+		claims.Issuer, claims.Subject).Scan(&linkedTo)
+	if err == nil {
+		if linkedTo != userID {
+			return errIdentityTaken
+		}
+		return nil
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("error retrieving identity: %w", err)
+	}
+
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, userID, claims.Issuer, claims.Subject, claims.Email, time.Now(), time.Now())
+	if err != nil {
+		return fmt.Errorf("error saving identity: %w", err)
+	}
+	if claims.EmailVerified {
+		_, err = db.DB.ExecContext(ctx, "UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ? AND email_verified_at IS NULL",
+			time.Now(), userID, claims.Email)
+		if err != nil {
+			log.Println("Error verifying email:", err)
+		}
+	}
+	return nil
+}
+
+// passwordLoginAllowed reports whether userID may log in with a password. With OIDC_PASSWORD_LOGIN
+// set to false, accounts linked to an identity have to use single sign-on.
+func passwordLoginAllowed(ctx context.Context, userID int) (bool, error) {
+	if oidc == nil || oidc.PasswordLogin {
+		return true, nil
+	}
+	var linked bool
+	err := db.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM user_identities WHERE user_id = ? AND issuer = ?)",
+		userID, oidc.Issuer).Scan(&linked)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving identities: %w", err)
+	}
+	return !linked, nil
+}
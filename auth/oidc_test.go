@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testClientID = "shareit-test"
+
+// fakeProvider is an OpenID Connect provider serving discovery, a JWKS and a token endpoint
+type fakeProvider struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	jwksFetches int
+	// idToken is what the token endpoint returns for the code "good"
+	idToken string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	f := &fakeProvider{keys: map[string]*rsa.PrivateKey{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwksFetches++
+		var keys []map[string]string
+		for kid, key := range f.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good" || r.PostFormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// addKey generates a signing key published under kid
+func (f *fakeProvider) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.keys[kid] = key
+	f.mu.Unlock()
+}
+
+// sign issues an ID token signed with the key under kid
+func (f *fakeProvider) sign(t *testing.T, kid string, claims jwt.Claims) string {
+	t.Helper()
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+	if key == nil {
+		// A key the provider does not publish
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (f *fakeProvider) fetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.jwksFetches
+}
+
+func testProvider(t *testing.T, f *fakeProvider) *oidcProvider {
+	t.Helper()
+	p := &oidcProvider{Issuer: f.URL, ClientID: testClientID, RedirectURL: "https://share.example.com/login/oidc/callback"}
+	if err := p.discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func validClaims(issuer string) *idTokenClaims {
+	now := time.Now()
+	return &idTokenClaims{
+		Nonce:         "nonce",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "alice",
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	f := newFakeProvider(t)
+	f.addKey(t, "k1")
+	p := testProvider(t, f)
+
+	tests := []struct {
+		name    string
+		kid     string
+		mutate  func(*idTokenClaims)
+		nonce   string
+		wantErr string
+	}{
+		{"valid", "k1", nil, "nonce", ""},
+		{"nonce mismatch", "k1", nil, "other", "nonce"},
+		{"no nonce", "k1", func(c *idTokenClaims) { c.Nonce = "" }, "", "nonce"},
+		{"other audience", "k1", func(c *idTokenClaims) { c.Audience = jwt.ClaimStrings{"someone-else"} }, "nonce", "not meant for this client"},
+		{"several audiences without azp", "k1", func(c *idTokenClaims) { c.Audience = append(c.Audience, "other") }, "nonce", "another client"},
+		{"several audiences with azp", "k1", func(c *idTokenClaims) {
+			c.Audience = append(c.Audience, "other")
+			c.AuthorizedParty = testClientID
+		}, "nonce", ""},
+		{"other issuer", "k1", func(c *idTokenClaims) { c.Issuer = "https://evil.example.com" }, "nonce", "issued by"},
+		{"expired", "k1", func(c *idTokenClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, "nonce", "expired"},
+		{"no expiry", "k1", func(c *idTokenClaims) { c.ExpiresAt = nil }, "nonce", "no expiry"},
+		{"no subject", "k1", func(c *idTokenClaims) { c.Subject = "" }, "nonce", "no subject"},
+		{"unpublished key", "k1-forged", nil, "nonce", "unknown signing key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims(f.URL)
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			raw := f.sign(t, tt.kid, claims)
+
+			got, err := p.verifyIDToken(context.Background(), raw, tt.nonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Subject != "alice" || got.Email != "alice@example.com" || !got.EmailVerified {
+				t.Fatalf("claims = %+v", got)
+			}
+		})
+	}
+
+	t.Run("signed with another key under a published kid", func(t *testing.T) {
+		forger := newFakeProvider(t)
+		forger.addKey(t, "k1")
+		raw := forger.sign(t, "k1", validClaims(f.URL))
+		if _, err := p.verifyIDToken(context.Background(), raw, "nonce"); err == nil {
+			t.Fatal("accepted a token with a bad signature")
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		raw, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims(f.URL)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		if _, err := p.verifyIDToken(context.Background(), raw, "nonce"); err == nil {
+			t.Fatal("accepted an unsigned token")
+		}
+	})
+}
+
+// The provider rolls its keys: a token under a new kid triggers one JWKS refetch, at most once
+// per jwksRefreshInterval
+func TestVerifyIDTokenKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeProvider(t)
+	f.addKey(t, "k1")
+	p := testProvider(t, f)
+
+	if _, err := p.verifyIDToken(ctx, f.sign(t, "k1", validClaims(f.URL)), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	if f.fetches() != 1 {
+		t.Fatalf("%d JWKS fetches, want 1", f.fetches())
+	}
+	if _, err := p.verifyIDToken(ctx, f.sign(t, "k1", validClaims(f.URL)), "nonce"); err != nil {
+		t.Fatal(err)
+	}
+	if f.fetches() != 1 {
+		t.Fatalf("%d JWKS fetches for a cached key, want 1", f.fetches())
+	}
+
+	// The new key is not picked up within the refresh interval
+	f.addKey(t, "k2")
+	if _, err := p.verifyIDToken(ctx, f.sign(t, "k2", validClaims(f.URL)), "nonce"); err == nil {
+		t.Fatal("JWKS refetched within jwksRefreshInterval")
+	}
+	if f.fetches() != 1 {
+		t.Fatalf("%d JWKS fetches, want 1", f.fetches())
+	}
+
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-jwksRefreshInterval)
+	p.mu.Unlock()
+	if _, err := p.verifyIDToken(ctx, f.sign(t, "k2", validClaims(f.URL)), "nonce"); err != nil {
+		t.Fatalf("token under the rotated key: %v", err)
+	}
+	if f.fetches() != 2 {
+		t.Fatalf("%d JWKS fetches, want 2", f.fetches())
+	}
+
+	// A retired key stops verifying once the JWKS is refetched
+	retired := f.sign(t, "k1", validClaims(f.URL))
+	f.mu.Lock()
+	delete(f.keys, "k1")
+	f.mu.Unlock()
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-jwksRefreshInterval)
+	p.mu.Unlock()
+	if _, err := p.verifyIDToken(ctx, f.sign(t, "k3", validClaims(f.URL)), "nonce"); err == nil {
+		t.Fatal("accepted a token under an unknown key")
+	}
+	if f.fetches() != 3 {
+		t.Fatalf("%d JWKS fetches, want 3", f.fetches())
+	}
+	if _, err := p.verifyIDToken(ctx, retired, "nonce"); err == nil {
+		t.Fatal("accepted a token under a retired key")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeProvider(t)
+	p := &oidcProvider{Issuer: f.URL}
+	if err := p.discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p.tokenEndpoint != f.URL+"/token" || p.jwksURI != f.URL+"/jwks" {
+		t.Errorf("endpoints = %q, %q", p.tokenEndpoint, p.jwksURI)
+	}
+
+	// A server answering with the discovery document of another issuer is not that issuer
+	impostor := httptest.NewServer(http.RedirectHandler(f.URL+"/.well-known/openid-configuration", http.StatusFound))
+	defer impostor.Close()
+	if err := (&oidcProvider{Issuer: impostor.URL}).discover(ctx); err == nil {
+		t.Error("accepted the discovery document of another issuer")
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeProvider(t)
+	f.idToken = "id.token.value"
+	p := testProvider(t, f)
+
+	if got, err := p.exchangeCode(ctx, "good", "verifier"); err != nil || got != "id.token.value" {
+		t.Fatalf("exchangeCode = %q, %v", got, err)
+	}
+	if _, err := p.exchangeCode(ctx, "bad", "verifier"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("exchangeCode with a rejected code: err = %v", err)
+	}
+}
+
+func TestStateCookie(t *testing.T) {
+	p := &oidcProvider{RedirectURL: "https://share.example.com/login/oidc/callback"}
+	rec := httptest.NewRecorder()
+	p.setStateCookie(rec, "state-1", 600)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies set, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/login/oidc/callback" {
+		t.Errorf("cookie = %+v", cookie)
+	}
+
+	callback := func(state string, cookie *http.Cookie) bool {
+		r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?state="+state, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return stateCookieMatches(r, state)
+	}
+	if !callback("state-1", cookie) {
+		t.Error("rejected the browser that started the login")
+	}
+	if callback("state-2", cookie) {
+		t.Error("accepted a state started in another browser")
+	}
+	if callback("state-1", nil) {
+		t.Error("accepted a callback without the cookie")
+	}
+	// The cookie holds a hash, so a state leaked from the cookie jar cannot be replayed as is
+	if callback("state-1", &http.Cookie{Name: oidcStateCookie, Value: "state-1"}) {
+		t.Error("accepted the raw state as cookie")
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/config"
+	"shareit/db"
+	"shareit/mail"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a reset token can be used (PASSWORD_RESET_TTL)
+var passwordResetTTL = time.Hour
+
+// InitPasswordReset takes the reset token lifetime from cfg
+func InitPasswordReset(cfg *config.Config) {
+	passwordResetTTL = cfg.PasswordResetTTL
+}
+
+// ForgotPasswordHandler mails a single-use reset token to the address if it belongs to an account.
+// The response is the same either way, and the mail is sent in the background, so the endpoint
+// does not reveal which addresses are registered.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var email string
+	err := db.DB.QueryRow("SELECT id, email FROM users WHERE email = ?", req.Email).Scan(&userID, &email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		go func() {
+			if err := SendPasswordReset(context.Background(), userID, email); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account exists for this address, a password reset email has been sent",
+	})
+}
+
+// SendPasswordReset creates a reset token for userID, replacing any earlier one, and mails it
+func SendPasswordReset(ctx context.Context, userID int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return fmt.Errorf("error generating reset token: %w", err)
+	}
+
+	// Only the newest token works
+	_, err = db.DB.ExecContext(ctx, "UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL",
+		time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("error invalidating reset tokens: %w", err)
+	}
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?)`, userID, hashToken(token), time.Now().Add(passwordResetTTL), time.Now())
+	if err != nil {
+		return fmt.Errorf("error saving reset token: %w", err)
+	}
+
+	return mail.Default.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Reset your ShareIt password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your ShareIt account.\n\n"+
+			"To choose a new password, send this token with POST /password/reset within %s:\n\n%s\n\n"+
+			"If this was not you, ignore this email; your password stays unchanged.\n", passwordResetTTL, token),
+	})
+}
+
+// ResetPasswordHandler sets a new password with a reset token. The token works once, and every
+// session of the account is logged out, so whoever knew the old password loses access.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	var resetID, userID int
+	var expiresAtStr string
+	var usedAt sql.NullString
+	err := db.DB.QueryRow("SELECT id, user_id, expires_at, used_at FROM password_resets WHERE token_hash = ?", hashToken(req.Token)).
+		Scan(&resetID, &userID, &expiresAtStr, &usedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving reset token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if expiresAt, _ := time.Parse("2006-01-02 15:04:05", expiresAtStr); usedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	// Claim the token and change the password together, so a token can never be used twice
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error resetting password:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), resetID)
+	if err != nil {
+		log.Println("Error using reset token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+	// The reset token arrived by mail, which proves the address as well as a verification link
+	_, err = tx.Exec("UPDATE users SET password = ?, email_verified_at = COALESCE(email_verified_at, ?) WHERE id = ?",
+		hashedPassword, time.Now(), userID)
+	if err != nil {
+		log.Println("Error updating password:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error resetting password:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := RevokeAllCredentials(r.Context(), userID); err != nil {
+		log.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/db"
+	"strings"
+	"time"
+)
+
+// Scopes of personal access tokens. Routes list the scopes they accept in RequireAuth; access
+// tokens from a login have every scope.
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopeSharesManage = "shares:manage"
+)
+
+var knownScopes = map[string]bool{ScopeFilesRead: true, ScopeFilesWrite: true, ScopeSharesManage: true}
+
+// patPrefix marks personal access tokens, so RequireAuth can tell them from JWTs (and secret
+// scanners can find leaked ones)
+const patPrefix = "sit_"
+
+// patTouchInterval limits how often the last use of a personal access token is written
+const patTouchInterval = time.Minute
+
+// PersonalAccessToken is a long-lived token for scripts and CI. The token itself is shown once,
+// when it is created; only its SHA-256 hash is stored.
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// patKey is the request context key RequireAuth stores the personal access token under
+type patKey struct{}
+
+// TokenFromContext returns the personal access token that authenticated the request, or nil when it
+// was authenticated by a login
+func TokenFromContext(ctx context.Context) *PersonalAccessToken {
+	pat, _ := ctx.Value(patKey{}).(*PersonalAccessToken)
+	return pat
+}
+
+// hasScopes reports whether the token carries every one of scopes. A route without scopes is
+// closed to personal access tokens.
+func (t *PersonalAccessToken) hasScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		found := false
+		for _, s := range t.Scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parseNullTime(s sql.NullString) *time.Time {
+	if !s.Valid {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", s.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// authenticatePAT looks up a personal access token and records its use. It returns nil for
+// unknown, expired and revoked tokens.
+func authenticatePAT(ctx context.Context, token string) (*PersonalAccessToken, int, error) {
+	var pat PersonalAccessToken
+	var userID int
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullString
+	err := db.DB.QueryRowContext(ctx, `SELECT id, user_id, name, scopes, expires_at, last_used_at FROM personal_access_tokens
+		WHERE token_hash = ? AND revoked_at IS NULL`, hashToken(token)).
+		Scan(&pat.ID, &userID, &pat.Name, &scopes, &expiresAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("error retrieving personal access token: %w", err)
+	}
+	pat.ExpiresAt = parseNullTime(expiresAt)
+	if pat.ExpiresAt != nil && time.Now().After(*pat.ExpiresAt) {
+		return nil, 0, nil
+	}
+	pat.Scopes = strings.Split(scopes, ",")
+
+	now := time.Now()
+	_, err = db.DB.ExecContext(ctx, `UPDATE personal_access_tokens SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`, now, pat.ID, now.Add(-patTouchInterval))
+	if err != nil {
+		log.Println("Error updating personal access token:", err)
+	}
+	return &pat, userID, nil
+}
+
+// ListTokens lists the caller's personal access tokens that are not revoked
+func ListTokens(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.DB.Query(`SELECT id, name, scopes, expires_at, last_used_at, created_at FROM personal_access_tokens
+		WHERE user_id = ? AND revoked_at IS NULL ORDER BY created_at DESC`, userID)
+	if err != nil {
+		log.Println("Error retrieving personal access tokens:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		var pat PersonalAccessToken
+		var scopes, createdAtStr string
+		var expiresAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&pat.ID, &pat.Name, &scopes, &expiresAt, &lastUsedAt, &createdAtStr); err != nil {
+			log.Println("Error scanning personal access token:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		pat.Scopes = strings.Split(scopes, ",")
+		pat.ExpiresAt = parseNullTime(expiresAt)
+		pat.LastUsedAt = parseNullTime(lastUsedAt)
+		pat.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		tokens = append(tokens, pat)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateToken creates a personal access token with the requested scopes and an optional expiry
+func CreateToken(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expires_in"` // Go duration, e.g. "2160h"; empty for no expiry
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(w, "name and scopes are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > 100 {
+		http.Error(w, "name is too long", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownScopes[scope] {
+			http.Error(w, fmt.Sprintf("Unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in must be a positive duration such as \"720h\"", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(d).Truncate(time.Second)
+		expiresAt = &t
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		log.Println("Error generating personal access token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token := patPrefix + secret
+
+	now := time.Now().Truncate(time.Second)
+	result, err := db.DB.Exec(`INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, userID, req.Name, hashToken(token), strings.Join(req.Scopes, ","), expiresAt, now)
+	if err != nil {
+		log.Println("Error creating personal access token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	tokenID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PersonalAccessToken{
+		ID:        int(tokenID),
+		Name:      req.Name,
+		Token:     token,
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	})
+}
+
+// RevokeToken revokes one of the caller's personal access tokens (?token_id=)
+func RevokeToken(w http.ResponseWriter, r *http.Request, userID int) {
+	tokenID := r.URL.Query().Get("token_id")
+
+	result, err := db.DB.Exec("UPDATE personal_access_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now(), tokenID, userID)
+	if err != nil {
+		log.Println("Error revoking personal access token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked successfully"})
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"shareit/db"
+)
+
+// Roles of an account (users.role)
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor" // read-only access to the admin API
+)
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin || role == RoleAuditor
+}
+
+// errAccountSuspended is returned by issueTokens for suspended accounts
+var errAccountSuspended = errors.New("account suspended")
+
+// account is the state of a user RequireAuth needs on every request
+type account struct {
+	ID        int
+	Verified  bool
+	Role      string
+	Suspended bool
+}
+
+// loadAccount loads the account matching where (a condition on users with one placeholder)
+func loadAccount(ctx context.Context, where string, arg interface{}) (account, error) {
+	var a account
+	err := db.DB.QueryRowContext(ctx, "SELECT id, email_verified_at IS NOT NULL, role, suspended_at IS NOT NULL FROM users WHERE "+where, arg).
+		Scan(&a.ID, &a.Verified, &a.Role, &a.Suspended)
+	return a, err
+}
+
+// accountSuspended reports whether userID is suspended
+func accountSuspended(ctx context.Context, userID int) (bool, error) {
+	a, err := loadAccount(ctx, "id = ?", userID)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving user: %w", err)
+	}
+	return a.Suspended, nil
+}
+
+// roleKey is the request context key RequireAuth stores the caller's role under
+type roleKey struct{}
+
+// RoleFromContext returns the role of the user that made the request
+func RoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+// RequireRole lets only users with one of roles through; wrap it inside RequireAuth
+func RequireRole(next func(w http.ResponseWriter, r *http.Request, userID int), roles ...string) func(w http.ResponseWriter, r *http.Request, userID int) {
+	return func(w http.ResponseWriter, r *http.Request, userID int) {
+		role := RoleFromContext(r.Context())
+		for _, allowed := range roles {
+			if role == allowed {
+				next(w, r, userID)
+				return
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
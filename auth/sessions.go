@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/db"
+	"shareit/rate_limiter"
+	"strconv"
+	"time"
+)
+
+// sessionTouchInterval limits how often RequireAuth writes the last use of a session
+const sessionTouchInterval = time.Minute
+
+// Session is a login on one device: a refresh token family together with where it was last used
+type Session struct {
+	ID         int       `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// clientIP is the address the request came from, behind trusted proxies as well
+func clientIP(r *http.Request) string {
+	return rate_limiter.ClientIP(r)
+}
+
+// userAgent is the request's User-Agent, cut to fit the sessions table
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return ua
+}
+
+// createSession records a new login for a fresh token family
+func createSession(r *http.Request, userID int, family string, expiresAt time.Time) error {
+	now := time.Now()
+	_, err := db.DB.ExecContext(r.Context(), `INSERT INTO sessions (user_id, family_id, ip, user_agent, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, userID, family, clientIP(r), userAgent(r), now, now, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+// extendSession records a refresh: the session lives as long as its newest refresh token
+func extendSession(r *http.Request, family string, expiresAt time.Time) error {
+	_, err := db.DB.ExecContext(r.Context(), `UPDATE sessions SET last_used_at = ?, ip = ?, user_agent = ?, expires_at = ?
+		WHERE family_id = ?`, time.Now(), clientIP(r), userAgent(r), expiresAt, family)
+	if err != nil {
+		return fmt.Errorf("error updating session: %w", err)
+	}
+	return nil
+}
+
+// touchSession records that a session was used, at most once per sessionTouchInterval. Failures
+// are only logged; they must not fail the request.
+func touchSession(r *http.Request, family string) {
+	if family == "" {
+		return
+	}
+	now := time.Now()
+	_, err := db.DB.ExecContext(r.Context(), `UPDATE sessions SET last_used_at = ?, ip = ?, user_agent = ?
+		WHERE family_id = ? AND last_used_at < ?`, now, clientIP(r), userAgent(r), family, now.Add(-sessionTouchInterval))
+	if err != nil {
+		log.Println("Error updating session:", err)
+	}
+}
+
+// ListSessions lists the caller's active sessions, most recently used first
+func ListSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	var current string
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		current = claims.Family
+	}
+
+	rows, err := db.DB.Query(`SELECT id, family_id, ip, user_agent, created_at, last_used_at, expires_at FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`, userID, time.Now())
+	if err != nil {
+		log.Println("Error retrieving sessions:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var family, createdAtStr, lastUsedAtStr, expiresAtStr string
+		if err := rows.Scan(&s.ID, &family, &s.IP, &s.UserAgent, &createdAtStr, &lastUsedAtStr, &expiresAtStr); err != nil {
+			log.Println("Error scanning session:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		s.LastUsedAt, _ = time.Parse("2006-01-02 15:04:05", lastUsedAtStr)
+		s.ExpiresAt, _ = time.Parse("2006-01-02 15:04:05", expiresAtStr)
+		s.Current = family == current
+		sessions = append(sessions, s)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeSession logs out one of the caller's sessions (?session_id=)
+func RevokeSession(w http.ResponseWriter, r *http.Request, userID int) {
+	sessionID, err := strconv.Atoi(r.URL.Query().Get("session_id"))
+	if err != nil {
+		http.Error(w, "session_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var family string
+	err = db.DB.QueryRow("SELECT family_id FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		Scan(&family)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving session:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeFamily(r.Context(), family); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked successfully"})
+}
+
+// revokeSessionsExcept logs out every session of userID except the one of the family except
+func revokeSessionsExcept(ctx context.Context, userID int, except string) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, "SELECT family_id FROM sessions WHERE user_id = ? AND family_id <> ? AND revoked_at IS NULL",
+		userID, except)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving sessions: %w", err)
+	}
+	var families []string
+	for rows.Next() {
+		var family string
+		if err := rows.Scan(&family); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error retrieving sessions: %w", err)
+		}
+		families = append(families, family)
+	}
+	rows.Close()
+
+	for i, family := range families {
+		if err := revokeFamily(ctx, family); err != nil {
+			return i, err
+		}
+	}
+	return len(families), nil
+}
+
+// RevokeAllSessions logs out every session of userID
+func RevokeAllSessions(ctx context.Context, userID int) error {
+	_, err := revokeSessionsExcept(ctx, userID, "")
+	return err
+}
+
+// RevokeAllCredentials logs out every session of userID and revokes all of their personal access
+// tokens, for password resets: a token created by whoever knew the old password must not survive
+func RevokeAllCredentials(ctx context.Context, userID int) error {
+	if err := RevokeAllSessions(ctx, userID); err != nil {
+		return err
+	}
+	_, err := db.DB.ExecContext(ctx, "UPDATE personal_access_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("error revoking personal access tokens: %w", err)
+	}
+	return nil
+}
+
+// RevokeOtherSessions logs out every session of the caller except the current one
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	var current string
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		current = claims.Family
+	}
+
+	revoked, err := revokeSessionsExcept(r.Context(), userID, current)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Other sessions revoked successfully",
+		"sessions_revoked": revoked,
+	})
+}
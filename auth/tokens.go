@@ -0,0 +1,346 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"shareit/config"
+	"shareit/db"
+	"sync"
+	"time"
+)
+
+// Token lifetimes; access tokens are short-lived because they are only checked against the
+// revocation list, refresh tokens are rotated on every use
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// InitTokens takes the JWT secret and the token lifetimes from cfg
+func InitTokens(cfg *config.Config) {
+	jwtSecret = []byte(cfg.JWTSecret)
+	accessTokenTTL = cfg.AccessTokenTTL
+	refreshTokenTTL = cfg.RefreshTokenTTL
+}
+
+// tokenResponse is returned by login and refresh. The refresh token is shown only here; the
+// database keeps its SHA-256 hash.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// randomToken returns n random bytes, base64url encoded
+func randomToken(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access token and a refresh token for userID. An empty family starts a
+// new token family and session (a login); refreshes continue the family of the token they replace.
+// Suspended accounts get errAccountSuspended.
+func issueTokens(r *http.Request, userID int, email, family string) (tokenResponse, error) {
+	ctx := r.Context()
+	suspended, err := accountSuspended(ctx, userID)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if suspended {
+		return tokenResponse{}, errAccountSuspended
+	}
+
+	expiresAt := time.Now().Add(refreshTokenTTL)
+	if family == "" {
+		if family, err = randomToken(16); err != nil {
+			return tokenResponse{}, err
+		}
+		if err := createSession(r, userID, family, expiresAt); err != nil {
+			return tokenResponse{}, err
+		}
+	} else if err := extendSession(r, family, expiresAt); err != nil {
+		return tokenResponse{}, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)`, userID, family, hashToken(refreshToken), expiresAt, time.Now())
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("error saving refresh token: %w", err)
+	}
+
+	accessToken, err := GenerateJWT(email, family)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("error generating access token: %w", err)
+	}
+
+	return tokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new refresh token. Every
+// refresh token works once: presenting one that was already used means it was stolen (or the
+// client is confused), so the whole family is revoked and both parties have to log in again.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	var tokenID, userID int
+	var family, email, expiresAtStr string
+	var usedAt, revokedAt sql.NullString
+	err := db.DB.QueryRow(`SELECT t.id, t.user_id, t.family_id, u.email, t.expires_at, t.used_at, t.revoked_at
+		FROM refresh_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash = ?`, hashToken(req.RefreshToken)).
+		Scan(&tokenID, &userID, &family, &email, &expiresAtStr, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving refresh token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if revokedAt.Valid {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if usedAt.Valid {
+		reuseDetected(r.Context(), userID, family)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if expiresAt, _ := time.Parse("2006-01-02 15:04:05", expiresAtStr); time.Now().After(expiresAt) {
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	// Claim the token atomically; losing the race to a concurrent refresh is reuse as well
+	result, err := db.DB.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL",
+		time.Now(), tokenID)
+	if err != nil {
+		log.Println("Error using refresh token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		reuseDetected(r.Context(), userID, family)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := issueTokens(r, userID, email, family)
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// reuseDetected kills the token family of a refresh token that was presented twice
+func reuseDetected(ctx context.Context, userID int, family string) {
+	log.Printf("Refresh token reuse detected for user %d, revoking token family", userID)
+	if err := revokeFamily(ctx, family); err != nil {
+		log.Println(err)
+	}
+}
+
+// LogoutHandler ends the session the access token belongs to: its refresh token family is revoked
+// and the access token itself stops working immediately
+func LogoutHandler(w http.ResponseWriter, r *http.Request, userID int) {
+	claims := ClaimsFromContext(r.Context())
+	if claims == nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	if claims.Family != "" {
+		if err := revokeFamily(r.Context(), claims.Family); err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := revokeAccessToken(r.Context(), claims); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
+
+// Revocation list keys in Redis. Entries only need to live as long as the access tokens they
+// revoke; after that the tokens are expired anyway.
+func revokedTokenKey(jti string) string     { return "revoked:jti:" + jti }
+func revokedFamilyKey(family string) string { return "revoked:family:" + family }
+
+// revocationSet remembers the revocations made by this instance until the tokens they revoke
+// expire. isRevoked consults it first, so they hold while Redis is unavailable; revocations made on
+// other instances during an outage only reach this one through Redis.
+type revocationSet struct {
+	mu        sync.Mutex
+	until     map[string]time.Time
+	lastSweep time.Time
+}
+
+var localRevocations = &revocationSet{until: map[string]time.Time{}}
+
+func (s *revocationSet) add(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, t := range s.until {
+			if !t.After(now) {
+				delete(s.until, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.until[key] = until
+}
+
+func (s *revocationSet) contains(keys ...string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if t, ok := s.until[key]; ok && t.After(time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeFamily ends a session: it revokes every refresh token of the family and every access
+// token issued with it
+func revokeFamily(ctx context.Context, family string) error {
+	_, err := db.DB.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+		time.Now(), family)
+	if err != nil {
+		return fmt.Errorf("error revoking refresh tokens: %w", err)
+	}
+	_, err = db.DB.ExecContext(ctx, "UPDATE sessions SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+		time.Now(), family)
+	if err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+	localRevocations.add(revokedFamilyKey(family), time.Now().Add(accessTokenTTL))
+	if err := db.RedisClient.Set(ctx, revokedFamilyKey(family), 1, accessTokenTTL).Err(); err != nil {
+		if !db.FailsOpen(db.FeatureRevocation, err) {
+			return fmt.Errorf("error revoking access tokens: %w", err)
+		}
+		log.Printf("Redis unavailable, access tokens of family %s are only revoked on this instance until they expire", family)
+	}
+	return nil
+}
+
+// revokeAccessToken puts a single access token on the revocation list until it expires
+func revokeAccessToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	localRevocations.add(revokedTokenKey(claims.ID), claims.ExpiresAt.Time)
+	if err := db.RedisClient.Set(ctx, revokedTokenKey(claims.ID), 1, ttl).Err(); err != nil {
+		if !db.FailsOpen(db.FeatureRevocation, err) {
+			return fmt.Errorf("error revoking access token: %w", err)
+		}
+		log.Printf("Redis unavailable, access token %s is only revoked on this instance until it expires", claims.ID)
+	}
+	return nil
+}
+
+// isRevoked checks an access token against the revocation list, the revocations of this instance
+// first
+func isRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	keys := []string{}
+	if claims.ID != "" {
+		keys = append(keys, revokedTokenKey(claims.ID))
+	}
+	if claims.Family != "" {
+		keys = append(keys, revokedFamilyKey(claims.Family))
+	}
+	if len(keys) == 0 {
+		return false, nil
+	}
+	if localRevocations.contains(keys...) {
+		return true, nil
+	}
+	n, err := db.RedisClient.Exists(ctx, keys...).Result()
+	return n > 0, err
+}
+
+// claimsKey is the request context key RequireAuth stores the access token claims under
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the access token that authenticated the request
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// PurgeExpiredTokens deletes expired refresh tokens, sessions, password reset and email verification
+// tokens. Used refresh tokens are kept until they expire so that a replay is still recognised as reuse.
+func PurgeExpiredTokens(ctx context.Context) (int64, error) {
+	result, err := db.DB.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired refresh tokens: %w", err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return purged, fmt.Errorf("error purging expired sessions: %w", err)
+	}
+	_, err = db.DB.ExecContext(ctx, "DELETE FROM password_resets WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return purged, fmt.Errorf("error purging expired password reset tokens: %w", err)
+	}
+	_, err = db.DB.ExecContext(ctx, "DELETE FROM email_verifications WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return purged, fmt.Errorf("error purging expired verification tokens: %w", err)
+	}
+	return purged, nil
+}
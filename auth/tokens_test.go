@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"shareit/db"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestRevocationWithoutRedis(t *testing.T) {
+	withRedisDown(t)
+	ctx := context.Background()
+	expires := jwt.NewNumericDate(time.Now().Add(time.Minute))
+	loggedOut := &Claims{RegisteredClaims: jwt.RegisteredClaims{ID: "revocation-test-1", ExpiresAt: expires}}
+	other := &Claims{RegisteredClaims: jwt.RegisteredClaims{ID: "revocation-test-2", ExpiresAt: expires}}
+
+	if err := revokeAccessToken(ctx, loggedOut); err != nil {
+		t.Fatalf("revokeAccessToken: %v", err)
+	}
+	// Revocations made by this instance hold while Redis is down
+	if revoked, err := isRevoked(ctx, loggedOut); !revoked || err != nil {
+		t.Errorf("isRevoked(revoked token) = %v, %v", revoked, err)
+	}
+	// Anything else cannot be checked: the error is for RequireAuth to weigh against the policy
+	if revoked, err := isRevoked(ctx, other); revoked || !db.FailsOpen(db.FeatureRevocation, err) {
+		t.Errorf("isRevoked(other token) = %v, %v", revoked, err)
+	}
+}
+
+func TestRevocationSetExpiry(t *testing.T) {
+	s := &revocationSet{until: map[string]time.Time{}}
+	s.add("revoked:jti:old", time.Now().Add(-time.Second))
+	s.add("revoked:family:f", time.Now().Add(time.Minute))
+	if s.contains("revoked:jti:old") {
+		t.Error("expired revocation still applies")
+	}
+	if !s.contains("revoked:jti:x", "revoked:family:f") {
+		t.Error("revoked family not found")
+	}
+	// The next add after a minute sweeps the expired entry
+	s.lastSweep = time.Now().Add(-2 * time.Minute)
+	s.add("revoked:jti:y", time.Now().Add(time.Minute))
+	if _, ok := s.until["revoked:jti:old"]; ok {
+		t.Error("expired revocation not swept")
+	}
+}
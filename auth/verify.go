@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"shareit/config"
+	"shareit/db"
+	"shareit/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// publicBaseURL prefixes the verification links sent to users (PUBLIC_BASE_URL)
+var publicBaseURL string
+
+// What unverified accounts may do (UNVERIFIED_POLICY)
+const (
+	unverifiedAllow    = "allow"    // everything
+	unverifiedRestrict = "restrict" // everything but sharing (routes wrapped in RequireVerified)
+	unverifiedBlock    = "block"    // nothing that needs authentication
+)
+
+var (
+	unverifiedPolicy = unverifiedRestrict
+	// verificationTTL is how long a verification link works (VERIFICATION_TOKEN_TTL)
+	verificationTTL = 48 * time.Hour
+	// verificationResendInterval is the minimum time between two verification mails to one
+	// address (VERIFICATION_RESEND_INTERVAL)
+	verificationResendInterval = time.Minute
+)
+
+// InitEmailVerification takes the base URL of the links, the policy for unverified accounts and the
+// token lifetime and resend interval from cfg
+func InitEmailVerification(cfg *config.Config) {
+	publicBaseURL = cfg.PublicBaseURL
+	unverifiedPolicy = cfg.UnverifiedPolicy
+	verificationTTL = cfg.VerificationTokenTTL
+	verificationResendInterval = cfg.VerificationResendInterval
+}
+
+// verifiedKey is the request context key RequireAuth stores whether the account is verified under
+type verifiedKey struct{}
+
+// RequireVerified lets only accounts with a verified email address through when UNVERIFIED_POLICY is
+// restrict; wrap it inside RequireAuth
+func RequireVerified(next func(w http.ResponseWriter, r *http.Request, userID int)) func(w http.ResponseWriter, r *http.Request, userID int) {
+	return func(w http.ResponseWriter, r *http.Request, userID int) {
+		if verified, _ := r.Context().Value(verifiedKey{}).(bool); !verified && unverifiedPolicy != unverifiedAllow {
+			http.Error(w, "Verify your email address first", http.StatusForbidden)
+			return
+		}
+		next(w, r, userID)
+	}
+}
+
+// resendAllowed throttles verification mails per address. The key is derived from the address rather
+// than the account, so unknown addresses are throttled the same way.
+func resendAllowed(ctx context.Context, email string) (bool, error) {
+	if verificationResendInterval == 0 {
+		return true, nil
+	}
+	key := "verify:resend:" + hashToken(strings.ToLower(email))
+	return db.RedisClient.SetNX(ctx, key, 1, verificationResendInterval).Result()
+}
+
+// sendVerification creates a verification token for userID, replacing any earlier one, and mails the
+// verification link
+func sendVerification(ctx context.Context, userID int, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return fmt.Errorf("error generating verification token: %w", err)
+	}
+
+	// Only the newest link works
+	_, err = db.DB.ExecContext(ctx, "UPDATE email_verifications SET used_at = ? WHERE user_id = ? AND used_at IS NULL",
+		time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("error invalidating verification tokens: %w", err)
+	}
+	_, err = db.DB.ExecContext(ctx, `INSERT INTO email_verifications (user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?)`, userID, hashToken(token), time.Now().Add(verificationTTL), time.Now())
+	if err != nil {
+		return fmt.Errorf("error saving verification token: %w", err)
+	}
+
+	link := publicBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return mail.Default.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Verify your ShareIt email address",
+		Body: fmt.Sprintf("Welcome to ShareIt!\n\nOpen this link within %s to verify your email address:\n\n%s\n\n"+
+			"If you did not sign up, ignore this email.\n", verificationTTL, link),
+	})
+}
+
+// VerifyEmailHandler marks the address of an account as verified (?token= from the verification mail)
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	var verificationID, userID int
+	var expiresAtStr string
+	var usedAt sql.NullString
+	err := db.DB.QueryRow("SELECT id, user_id, expires_at, used_at FROM email_verifications WHERE token_hash = ?", hashToken(token)).
+		Scan(&verificationID, &userID, &expiresAtStr, &usedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving verification token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if expiresAt, _ := time.Parse("2006-01-02 15:04:05", expiresAtStr); usedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error verifying email:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE email_verifications SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), verificationID)
+	if err != nil {
+		log.Println("Error using verification token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+	_, err = tx.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL", time.Now(), userID)
+	if err != nil {
+		log.Println("Error verifying email:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error verifying email:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address verified successfully"})
+}
+
+// ResendVerificationHandler mails a new verification link to an unverified account. Like
+// ForgotPasswordHandler it answers the same for unknown and already verified addresses; only the
+// throttle (one mail per VERIFICATION_RESEND_INTERVAL and address) is visible.
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := resendAllowed(r.Context(), req.Email)
+	if db.FailsOpen(db.FeatureResend, err) {
+		allowed, err = true, nil
+	}
+	if err != nil {
+		log.Println("Error checking verification throttle:", err)
+		http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(verificationResendInterval.Seconds())))
+		http.Error(w, "A verification email was sent recently, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var userID int
+	var email string
+	err = db.DB.QueryRow("SELECT id, email FROM users WHERE email = ? AND email_verified_at IS NULL", req.Email).
+		Scan(&userID, &email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		go func() {
+			if err := sendVerification(context.Background(), userID, email); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an unverified account exists for this address, a verification email has been sent",
+	})
+}
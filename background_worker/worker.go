@@ -1,105 +1,106 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"time"
 
+	"shareit/auth"
+	"shareit/config"
 	"shareit/db" // Update this import path based on your actual module path
+	"shareit/files"
+	"shareit/storage"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load environment variables from .env file
-	err := godotenv.Load()
+	// Same configuration as the API server: config file, environment, flags
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		log.Fatal(err)
 	}
+	log.Printf("Effective configuration:\n%s", cfg.Dump())
 
-	// Retrieve configuration from environment variables
-	cleanupIntervalStr := os.Getenv("CLEANUP_INTERVAL")
-	expiryDurationStr := os.Getenv("EXPIRY_DURATION")
+	// Initialize the database connection
+	db.ConnectDB(cfg)
+	defer db.DB.Close()
 
-	cleanupInterval, err := time.ParseDuration(cleanupIntervalStr)
-	if err != nil {
-		log.Fatalf("Error parsing CLEANUP_INTERVAL: %v", err)
-	}
+	// Removing files invalidates the metadata the API server caches in Redis
+	db.ConnectRedis(cfg)
 
-	expiryDuration, err := time.ParseDuration(expiryDurationStr)
-	if err != nil {
-		log.Fatalf("Error parsing EXPIRY_DURATION: %v", err)
+	// Initialize the storage backend the API server writes blobs to
+	storage.Connect(cfg)
+	// The default staging directory is relative to the working directory, which differs from the API
+	// server's when the worker runs from background_worker/
+	if cfg.TusUploadDir == "" {
+		log.Fatal("TUS_UPLOAD_DIR must be set for the worker to the directory the API server stages resumable uploads in")
 	}
+	files.InitResumableUploads(cfg)
 
-	// Initialize the database connection
-	db.ConnectDB()
-	defer db.DB.Close()
-
-	ticker := time.NewTicker(cleanupInterval)
+	ticker := time.NewTicker(cfg.CleanupInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		if err := cleanupOldFiles(expiryDuration); err != nil {
+		if err := cleanupOldFiles(cfg.ExpiryDuration); err != nil {
 			log.Printf("Error during cleanup: %v", err)
 		}
+		if err := files.PurgeExpiredUploads(); err != nil {
+			log.Printf("Error purging expired resumable uploads: %v", err)
+		}
+		if purged, err := files.PurgeTrash(context.Background(), cfg.TrashRetention); err != nil {
+			log.Printf("Error purging trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d files from the trash", purged)
+		}
+		if _, err := auth.PurgeExpiredTokens(context.Background()); err != nil {
+			log.Printf("Error purging expired refresh tokens: %v", err)
+		}
+		if pruned, err := files.PruneVersions(context.Background(), cfg.VersionRetentionCount,
+			time.Duration(cfg.VersionRetentionDays)*24*time.Hour); err != nil {
+			log.Printf("Error pruning file versions: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d old file versions", pruned)
+		}
+		if collected, err := files.CollectOrphanBlobs(context.Background()); err != nil {
+			log.Printf("Error collecting unreferenced blobs: %v", err)
+		} else if collected > 0 {
+			log.Printf("Deleted %d unreferenced blobs", collected)
+		}
 	}
 }
 
 func cleanupOldFiles(expiryDuration time.Duration) error {
-	// Define the cutoff time for file deletion
+	// Define the cutoff time for file deletion; a new version keeps a file alive
 	cutoffTime := time.Now().Add(-expiryDuration)
 
-	// Optionally, delete files from storage
-	err := deleteOldFilesFromStorage(cutoffTime)
+	rows, err := db.DB.Query("SELECT id FROM files WHERE updated_at < ?", cutoffTime)
 	if err != nil {
-		log.Println(err)
-		return fmt.Errorf("error deleting old files from storage: %w", err)
+		return fmt.Errorf("error querying old files: %w", err)
 	}
-
-	// Delete old file metadata from the database
-	_, err = db.DB.Exec("DELETE FROM files WHERE created_at < ?", cutoffTime)
-	if err != nil {
-		return fmt.Errorf("error deleting old file metadata from database: %w", err)
+	var fileIDs []int
+	for rows.Next() {
+		var fileID int
+		if err := rows.Scan(&fileID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning file id: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
 	}
+	rows.Close()
 
+	// Release every version's blob; blobs still referenced by other files are kept
+	for _, fileID := range fileIDs {
+		log.Printf("Attempting to delete file: %d", fileID)
+		if err := files.RemoveFile(context.Background(), fileID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("error deleting file %d: %v", fileID, err)
+		}
+	}
 
 	log.Println("Old files cleaned up successfully")
 	return nil
 }
-
-func deleteOldFilesFromStorage(cutoffTime time.Time) error {
-    rows, err := db.DB.Query("SELECT file_path FROM files WHERE created_at < ?", cutoffTime)
-    if err != nil {
-        return fmt.Errorf("error querying old file paths: %w", err)
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var filePath string
-        if err := rows.Scan(&filePath); err != nil {
-            return fmt.Errorf("error scanning file path: %w", err)
-        }
-
-        // Adjust file path to point to the correct uploads directory
-        relativePath := filepath.Join("..", "uploads", filepath.Base(filePath))
-
-        // Convert the adjusted relative path to absolute path
-        absPath, err := filepath.Abs(relativePath)
-        if err != nil {
-            log.Printf("error getting absolute path for file %s: %v", relativePath, err)
-            continue
-        }
-
-        log.Printf("Attempting to delete file at path: %s", absPath)
-
-        // Delete the file from the file system
-        if err := os.Remove(absPath); err != nil {
-            log.Printf("error deleting file %s: %v", absPath, err)
-        }
-    }
-
-    return nil
-}
\ No newline at end of file
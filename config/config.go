@@ -0,0 +1,571 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds every setting of the API server, the worker and the operator commands; the packages
+// take theirs from it in their Init and Connect functions. Fields are filled from their `env` key;
+// `flag` adds a command line flag and `secret` keeps the value out of the startup dump ("url" only
+// hides the password of a URL). Field types other than strings, bools, numbers and durations parse
+// themselves with UnmarshalText.
+type Config struct {
+	// ListenAddr is the address the API server listens on
+	ListenAddr string `env:"LISTEN_ADDR" flag:"listen" default:":8080"`
+	// PublicBaseURL prefixes the links handed out to users: share links, email verification links
+	// and the default single sign-on redirect
+	PublicBaseURL string `env:"PUBLIC_BASE_URL" flag:"base-url" default:"http://localhost:8080"`
+	// JWTSecret signs the access tokens, at least 32 bytes
+	JWTSecret string `env:"JWT_SECRET" secret:"true"`
+
+	DBUser     string `env:"DB_USER"`
+	DBPassword string `env:"DB_PASSWORD" secret:"true"`
+	DBHost     string `env:"DB_HOST" default:"localhost:3306"`
+	DBName     string `env:"DB_NAME" default:"shareit"`
+
+	// RedisURL is a redis:// or, for TLS, rediss:// URL including the credentials
+	RedisURL string `env:"REDIS_URL" secret:"url"`
+	// RedisTLSInsecure skips the verification of the Redis server certificate
+	RedisTLSInsecure bool `env:"REDIS_TLS_INSECURE_SKIP_VERIFY"`
+
+	// StorageBackend is where blobs are stored: "local" (below StorageLocalDir) or "s3"
+	StorageBackend   string `env:"STORAGE_BACKEND" default:"local"`
+	StorageLocalDir  string `env:"STORAGE_LOCAL_DIR" default:"./uploads"`
+	S3Endpoint       string `env:"S3_ENDPOINT"`
+	S3Region         string `env:"S3_REGION"`
+	S3Bucket         string `env:"S3_BUCKET"`
+	S3AccessKey      string `env:"S3_ACCESS_KEY"`
+	S3SecretKey      string `env:"S3_SECRET_KEY" secret:"true"`
+	S3ForcePathStyle bool   `env:"S3_FORCE_PATH_STYLE"`
+
+	// KeyProvider wraps the data keys: "keyring" (MASTER_KEYS_FILE and/or MASTER_KEYS) or "vault"
+	KeyProvider string `env:"KEY_PROVIDER" default:"keyring"`
+	// MasterKeysFile is the keyring file, one "id=base64key" per line
+	MasterKeysFile string `env:"MASTER_KEYS_FILE"`
+	// MasterKeys are inline "id:base64key" pairs, comma separated
+	MasterKeys string `env:"MASTER_KEYS" secret:"true"`
+	// MasterKeyID pins the key new data keys are wrapped under; by default the last key listed
+	MasterKeyID       string `env:"MASTER_KEY_ID"`
+	VaultAddr         string `env:"VAULT_ADDR"`
+	VaultToken        string `env:"VAULT_TOKEN" secret:"true"`
+	VaultTransitMount string `env:"VAULT_TRANSIT_MOUNT"`
+	VaultTransitKey   string `env:"VAULT_TRANSIT_KEY"`
+
+	// CleanupInterval is how often the worker runs
+	CleanupInterval time.Duration `env:"CLEANUP_INTERVAL" default:"24h"`
+	// ExpiryDuration removes files that have not received a new version for this long
+	ExpiryDuration time.Duration `env:"EXPIRY_DURATION" default:"168h"`
+	// TrashRetention is how long deleted files can be restored
+	TrashRetention time.Duration `env:"TRASH_RETENTION" default:"720h"`
+	// VersionRetentionCount keeps the newest N versions of each file, 0 keeps all
+	VersionRetentionCount int `env:"VERSION_RETENTION_COUNT"`
+	// VersionRetentionDays drops older versions after N days, 0 keeps them
+	VersionRetentionDays int `env:"VERSION_RETENTION_DAYS"`
+
+	// AccessTokenTTL is short because access tokens are only checked against the revocation list;
+	// refresh tokens are rotated on every use
+	AccessTokenTTL  time.Duration `env:"ACCESS_TOKEN_TTL" default:"15m"`
+	RefreshTokenTTL time.Duration `env:"REFRESH_TOKEN_TTL" default:"720h"`
+	// PasswordResetTTL is how long a reset token can be used
+	PasswordResetTTL time.Duration `env:"PASSWORD_RESET_TTL" default:"1h"`
+	// UnverifiedPolicy is what accounts with an unverified email address may do: allow, restrict
+	// (no sharing) or block (no login)
+	UnverifiedPolicy     string        `env:"UNVERIFIED_POLICY" default:"restrict"`
+	VerificationTokenTTL time.Duration `env:"VERIFICATION_TOKEN_TTL" default:"48h"`
+	// VerificationResendInterval is the minimum time between two verification mails to one address
+	VerificationResendInterval time.Duration `env:"VERIFICATION_RESEND_INTERVAL" default:"1m"`
+	// MFAIssuer names the service in authenticator apps
+	MFAIssuer string `env:"MFA_ISSUER" default:"ShareIt"`
+	// MFAChallengeTTL is how long the second login step can take
+	MFAChallengeTTL time.Duration `env:"MFA_CHALLENGE_TTL" default:"5m"`
+	// LoginMaxAttempts and LoginIPMaxAttempts are the failed logins an account and a client address
+	// may have before backoff starts; LoginLockoutMax caps the backoff
+	LoginMaxAttempts   int           `env:"LOGIN_MAX_ATTEMPTS" default:"5"`
+	LoginIPMaxAttempts int           `env:"LOGIN_IP_MAX_ATTEMPTS" default:"20"`
+	LoginLockoutMax    time.Duration `env:"LOGIN_LOCKOUT_MAX" default:"15m"`
+
+	// OIDCIssuer enables single sign-on through that OpenID Connect provider
+	OIDCIssuer       string `env:"OIDC_ISSUER"`
+	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET" secret:"true"`
+	// OIDCRedirectURL defaults to the callback under PublicBaseURL
+	OIDCRedirectURL string `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes      string `env:"OIDC_SCOPES" default:"openid email profile"`
+	// OIDCAutoProvision creates accounts for unknown identities
+	OIDCAutoProvision bool `env:"OIDC_AUTO_PROVISION" default:"true"`
+	// OIDCLinkByEmail links an identity to the account with its verified email address, trusting
+	// the provider with every existing account
+	OIDCLinkByEmail bool `env:"OIDC_LINK_BY_EMAIL"`
+	// OIDCPasswordLogin lets accounts linked to an identity log in with a password as well
+	OIDCPasswordLogin bool `env:"OIDC_PASSWORD_LOGIN" default:"true"`
+
+	// MailBackend is "smtp", or "outbox" for development; the API server requires it
+	MailBackend string `env:"MAIL_BACKEND"`
+	MailFrom    string `env:"MAIL_FROM" default:"ShareIt <no-reply@localhost>"`
+	// MailOutboxDir is where the outbox writes mails; unset, it only logs their recipients
+	MailOutboxDir string `env:"MAIL_OUTBOX_DIR"`
+	SMTPAddr      string `env:"SMTP_ADDR"`
+	SMTPUsername  string `env:"SMTP_USERNAME"`
+	SMTPPassword  string `env:"SMTP_PASSWORD" secret:"true"`
+
+	// RedisBreakerThreshold consecutive connection failures open the circuit breaker, which then
+	// lets one probe through every RedisBreakerCooldown
+	RedisBreakerThreshold int           `env:"REDIS_BREAKER_THRESHOLD" default:"5"`
+	RedisBreakerCooldown  time.Duration `env:"REDIS_BREAKER_COOLDOWN" default:"10s"`
+	// RedisFallbackCacheSize is how many metadata entries are cached in process while Redis is down
+	RedisFallbackCacheSize int `env:"REDIS_FALLBACK_CACHE_SIZE" default:"1000"`
+	// RedisFailPolicy overrides whether features fail open or closed while Redis is down
+	RedisFailPolicy FailPolicy `env:"REDIS_FAIL_POLICY"`
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is believed
+	TrustedProxies Networks `env:"TRUSTED_PROXIES"`
+
+	// DedupScope is which uploads share blobs: user, global or off
+	DedupScope string `env:"DEDUP_SCOPE" default:"user"`
+	// QuotaDefaultBytes and QuotaDefaultFiles apply to users without a quota of their own; 0 is
+	// unlimited
+	QuotaDefaultBytes int64 `env:"QUOTA_DEFAULT_BYTES"`
+	QuotaDefaultFiles int64 `env:"QUOTA_DEFAULT_FILES"`
+	// TusUploadDir stages resumable uploads, ./tus_uploads when unset; the worker requires it
+	TusUploadDir    string        `env:"TUS_UPLOAD_DIR"`
+	TusUploadExpiry time.Duration `env:"TUS_UPLOAD_EXPIRY" default:"24h"`
+	// TusMaxSize limits the size of resumable uploads, 0 is unlimited
+	TusMaxSize int64 `env:"TUS_MAX_SIZE"`
+}
+
+// redisFeatures are the features REDIS_FAIL_POLICY can set, see db.FailsOpen
+var redisFeatures = map[string]bool{"ratelimit": true, "revocation": true, "lockout": true, "resend": true}
+
+// FailPolicy maps Redis dependent features to whether they fail open, read from a comma separated
+// list such as "revocation=closed,lockout=open"
+type FailPolicy map[string]bool
+
+func (p *FailPolicy) UnmarshalText(text []byte) error {
+	policy := FailPolicy{}
+	for _, entry := range strings.Split(string(text), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		feature, mode, _ := strings.Cut(entry, "=")
+		if !redisFeatures[feature] || (mode != "open" && mode != "closed") {
+			return fmt.Errorf("invalid entry %q: must be feature=open or feature=closed with a feature of ratelimit, revocation, lockout, resend", entry)
+		}
+		policy[feature] = mode == "open"
+	}
+	*p = policy
+	return nil
+}
+
+func (p FailPolicy) String() string {
+	var entries []string
+	for feature, open := range p {
+		mode := "closed"
+		if open {
+			mode = "open"
+		}
+		entries = append(entries, feature+"="+mode)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Networks is a comma separated list of IP addresses and CIDR ranges
+type Networks []*net.IPNet
+
+func (n *Networks) UnmarshalText(text []byte) error {
+	var networks Networks
+	for _, entry := range strings.Split(string(text), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid entry %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	*n = networks
+	return nil
+}
+
+func (n Networks) String() string {
+	entries := make([]string, len(n))
+	for i, network := range n {
+		entries[i] = network.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// noSecretFile are secrets whose KEY_FILE already means something else, so Load does not read them
+// from that file. MASTER_KEYS_FILE is the path of the keyring file (one "id=key" per line), which
+// the encryption package reads and "shareit keys rotate" appends to; MASTER_KEYS is only given
+// inline.
+var noSecretFile = map[string]bool{
+	"MASTER_KEYS": true,
+}
+
+// Load reads the configuration; later sources override earlier ones:
+//
+//  1. the defaults above
+//  2. the config file, a .env style KEY=value file: -config, else SHAREIT_CONFIG, else ./.env if
+//     it exists
+//  3. environment variables
+//  4. command line flags (args, without the program name)
+//
+// Every secret KEY may instead be given as KEY_FILE, the path of a file holding it (e.g. a Docker or
+// Kubernetes secret). Every setting is validated here, so the packages can take them as they are.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("shareit", flag.ExitOnError)
+	configFile := flags.String("config", "", "path of the configuration file")
+	fields := typedFields()
+	flagValues := map[string]*string{}
+	for _, f := range fields {
+		if f.flag != "" {
+			flagValues[f.env] = flags.String(f.flag, "", "overrides "+f.env)
+		}
+	}
+	flags.Parse(args)
+
+	path, explicit := *configFile, true
+	if path == "" {
+		path = os.Getenv("SHAREIT_CONFIG")
+	}
+	if path == "" {
+		path, explicit = ".env", false
+	}
+	file, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		file, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+	for key := range file {
+		if !known(key) {
+			return nil, fmt.Errorf("unknown setting %s in %s", key, path)
+		}
+	}
+
+	env := map[string]string{}
+	for _, key := range knownKeys() {
+		if v := os.Getenv(key); v != "" {
+			env[key] = v
+		}
+	}
+
+	// Secret files are resolved per source, so that KEY_FILE in the environment overrides KEY in
+	// the config file
+	values := map[string]string{}
+	for _, source := range []map[string]string{file, env} {
+		if err := readSecretFiles(source); err != nil {
+			return nil, err
+		}
+		for key, v := range source {
+			values[key] = v
+		}
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	c := &Config{}
+	v := reflect.ValueOf(c).Elem()
+	var problems []error
+	for _, f := range fields {
+		raw, ok := values[f.env]
+		if f.flag != "" && set[f.flag] {
+			raw, ok = *flagValues[f.env], true
+		}
+		// Empty values mean the default, in the config file just as in the environment
+		if !ok || raw == "" {
+			raw = f.def
+		}
+		if err := assign(v.Field(f.index), raw); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", f.env, err))
+		}
+	}
+	c.PublicBaseURL = strings.TrimRight(c.PublicBaseURL, "/")
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %w", errors.Join(problems...))
+	}
+	return c, nil
+}
+
+// validate checks the settings beyond their types
+func (c *Config) validate() []error {
+	var problems []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		problems = append(problems, fmt.Errorf("LISTEN_ADDR: %w", err))
+	}
+	if u, err := url.Parse(c.PublicBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, errors.New("PUBLIC_BASE_URL: must be an absolute http(s) URL"))
+	}
+	if len(c.JWTSecret) < 32 {
+		problems = append(problems, errors.New("JWT_SECRET: must be at least 32 bytes, e.g. openssl rand -base64 32"))
+	}
+	required := []struct{ key, value string }{
+		{"DB_USER", c.DBUser}, {"DB_HOST", c.DBHost}, {"DB_NAME", c.DBName}, {"REDIS_URL", c.RedisURL},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, fmt.Errorf("%s: required", r.key))
+		}
+	}
+	if c.RedisURL != "" {
+		if u, err := url.Parse(c.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			problems = append(problems, errors.New("REDIS_URL: must be a redis:// or rediss:// URL"))
+		}
+	}
+	if c.StorageBackend != "local" && c.StorageBackend != "s3" {
+		problems = append(problems, errors.New("STORAGE_BACKEND: must be local or s3"))
+	}
+	if c.KeyProvider != "keyring" && c.KeyProvider != "vault" {
+		problems = append(problems, errors.New("KEY_PROVIDER: must be keyring or vault"))
+	}
+	choices := []struct {
+		key, value string
+		allowed    []string
+	}{
+		{"UNVERIFIED_POLICY", c.UnverifiedPolicy, []string{"allow", "restrict", "block"}},
+		{"DEDUP_SCOPE", c.DedupScope, []string{"user", "global", "off"}},
+		{"MAIL_BACKEND", c.MailBackend, []string{"smtp", "outbox"}},
+	}
+	for _, ch := range choices {
+		// MAIL_BACKEND has no default; the worker sends no mail
+		if ch.value != "" && !contains(ch.allowed, ch.value) {
+			problems = append(problems, fmt.Errorf("%s: must be one of %s", ch.key, strings.Join(ch.allowed, ", ")))
+		}
+	}
+	if c.MailBackend == "smtp" && c.SMTPAddr == "" {
+		problems = append(problems, errors.New("SMTP_ADDR: required for the smtp mail backend"))
+	}
+	if c.OIDCIssuer != "" {
+		if u, err := url.Parse(c.OIDCIssuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, errors.New("OIDC_ISSUER: must be an absolute http(s) URL"))
+		}
+		if c.OIDCClientID == "" {
+			problems = append(problems, errors.New("OIDC_CLIENT_ID: required when OIDC_ISSUER is set"))
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"CLEANUP_INTERVAL", c.CleanupInterval}, {"EXPIRY_DURATION", c.ExpiryDuration}, {"TRASH_RETENTION", c.TrashRetention},
+		{"ACCESS_TOKEN_TTL", c.AccessTokenTTL}, {"REFRESH_TOKEN_TTL", c.RefreshTokenTTL}, {"PASSWORD_RESET_TTL", c.PasswordResetTTL},
+		{"VERIFICATION_TOKEN_TTL", c.VerificationTokenTTL}, {"MFA_CHALLENGE_TTL", c.MFAChallengeTTL},
+		{"REDIS_BREAKER_COOLDOWN", c.RedisBreakerCooldown}, {"TUS_UPLOAD_EXPIRY", c.TusUploadExpiry},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			problems = append(problems, fmt.Errorf("%s: must be positive", d.key))
+		}
+	}
+	if c.VerificationResendInterval < 0 {
+		problems = append(problems, errors.New("VERIFICATION_RESEND_INTERVAL: must not be negative"))
+	}
+	if c.LoginLockoutMax < time.Second {
+		problems = append(problems, errors.New("LOGIN_LOCKOUT_MAX: must be at least 1s"))
+	}
+
+	counts := []struct {
+		key   string
+		value int64
+		min   int64
+	}{
+		{"VERSION_RETENTION_COUNT", int64(c.VersionRetentionCount), 0}, {"VERSION_RETENTION_DAYS", int64(c.VersionRetentionDays), 0},
+		{"LOGIN_MAX_ATTEMPTS", int64(c.LoginMaxAttempts), 1}, {"LOGIN_IP_MAX_ATTEMPTS", int64(c.LoginIPMaxAttempts), 1},
+		{"REDIS_BREAKER_THRESHOLD", int64(c.RedisBreakerThreshold), 1}, {"REDIS_FALLBACK_CACHE_SIZE", int64(c.RedisFallbackCacheSize), 0},
+		{"QUOTA_DEFAULT_BYTES", c.QuotaDefaultBytes, 0}, {"QUOTA_DEFAULT_FILES", c.QuotaDefaultFiles, 0}, {"TUS_MAX_SIZE", c.TusMaxSize, 0},
+	}
+	for _, n := range counts {
+		switch {
+		case n.value >= n.min:
+		case n.min == 0:
+			problems = append(problems, fmt.Errorf("%s: must not be negative", n.key))
+		default:
+			problems = append(problems, fmt.Errorf("%s: must be at least %d", n.key, n.min))
+		}
+	}
+	return problems
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Dump lists the effective configuration for the startup log, one KEY=value per line, with secrets
+// redacted
+func (c *Config) Dump() string {
+	v := reflect.ValueOf(c).Elem()
+	var lines []string
+	for _, f := range typedFields() {
+		lines = append(lines, f.env+"="+redact(fmt.Sprint(v.Field(f.index).Interface()), f.secret))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func redact(value, secret string) string {
+	switch {
+	case value == "" || secret == "":
+		return value
+	case secret == "url":
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+	}
+	return "<redacted>"
+}
+
+// field describes one typed setting of Config
+type field struct {
+	index  int
+	env    string
+	flag   string
+	def    string
+	secret string
+}
+
+func typedFields() []field {
+	t := reflect.TypeOf(Config{})
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		if tag.Get("env") == "" {
+			continue
+		}
+		fields = append(fields, field{index: i, env: tag.Get("env"), flag: tag.Get("flag"), def: tag.Get("default"), secret: tag.Get("secret")})
+	}
+	return fields
+}
+
+// assign parses raw into a typed field
+func assign(v reflect.Value, raw string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(raw))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b := false
+		if raw != "" {
+			var err error
+			if b, err = strconv.ParseBool(raw); err != nil {
+				return errors.New("must be true or false")
+			}
+		}
+		v.SetBool(b)
+	case reflect.Int64:
+		if v.Type() != reflect.TypeOf(time.Duration(0)) {
+			n := int64(0)
+			if raw != "" {
+				var err error
+				if n, err = strconv.ParseInt(raw, 10, 64); err != nil {
+					return errors.New("must be a whole number")
+				}
+			}
+			v.SetInt(n)
+			return nil
+		}
+		d := time.Duration(0)
+		if raw != "" {
+			var err error
+			if d, err = time.ParseDuration(raw); err != nil {
+				return errors.New("must be a duration such as 24h")
+			}
+		}
+		v.SetInt(int64(d))
+	case reflect.Int:
+		n := 0
+		if raw != "" {
+			var err error
+			if n, err = strconv.Atoi(raw); err != nil {
+				return errors.New("must be a whole number")
+			}
+		}
+		v.SetInt(int64(n))
+	}
+	return nil
+}
+
+// secretKeys are the keys that may be given as KEY_FILE
+func secretKeys() []string {
+	var keys []string
+	for _, f := range typedFields() {
+		if f.secret != "" && !noSecretFile[f.env] {
+			keys = append(keys, f.env)
+		}
+	}
+	return keys
+}
+
+// readSecretFiles replaces KEY_FILE entries by KEY with the content of the file
+func readSecretFiles(values map[string]string) error {
+	for _, key := range secretKeys() {
+		path, ok := values[key+"_FILE"]
+		if !ok {
+			continue
+		}
+		if _, both := values[key]; both {
+			return fmt.Errorf("both %s and %s_FILE are set", key, key)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading %s_FILE: %w", key, err)
+		}
+		values[key] = strings.TrimRight(string(data), "\r\n")
+		delete(values, key+"_FILE")
+	}
+	return nil
+}
+
+// knownKeys are all keys Load looks for in the environment
+func knownKeys() []string {
+	var keys []string
+	for _, f := range typedFields() {
+		keys = append(keys, f.env)
+	}
+	for _, key := range secretKeys() {
+		keys = append(keys, key+"_FILE")
+	}
+	return keys
+}
+
+func known(key string) bool {
+	for _, k := range knownKeys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
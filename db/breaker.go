@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrRedisUnavailable is returned instead of running a command while the circuit breaker is open
+var ErrRedisUnavailable = errors.New("redis unavailable")
+
+// circuitBreaker stops sending commands to Redis after threshold consecutive connection failures.
+// While open, one command per cooldown is let through as a probe; the first success closes it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	probeAt   time.Time
+	// onRecover runs after the breaker closed again
+	onRecover func()
+}
+
+// allow reports whether a command may be sent
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if time.Now().Before(b.probeAt) {
+		return false
+	}
+	b.probeAt = time.Now().Add(b.cooldown)
+	return true
+}
+
+// record counts the outcome of a command that was sent
+func (b *circuitBreaker) record(err error) {
+	if errors.Is(err, ErrRedisUnavailable) {
+		// Rejected by the breaker itself; Redis was not asked
+		return
+	}
+	if !Unavailable(err) {
+		b.mu.Lock()
+		recovered := b.open
+		b.open = false
+		b.failures = 0
+		b.mu.Unlock()
+		if recovered {
+			log.Println("Redis is available again, circuit breaker closed")
+			if b.onRecover != nil {
+				go b.onRecover()
+			}
+		}
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.open {
+		// A failed probe; wait a full cooldown before the next one
+		b.probeAt = time.Now().Add(b.cooldown)
+		return
+	}
+	if b.failures >= b.threshold {
+		b.open = true
+		b.probeAt = time.Now().Add(b.cooldown)
+		log.Printf("Redis unavailable after %d failures, circuit breaker open: %v", b.failures, err)
+	}
+}
+
+// trip opens the breaker at once, e.g. when Redis cannot be reached at startup
+func (b *circuitBreaker) trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open = true
+	b.probeAt = time.Now().Add(b.cooldown)
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// BeforeProcess, AfterProcess and the pipeline variants make the breaker a go-redis hook, so every
+// command sent through RedisClient goes through it
+func (b *circuitBreaker) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !b.allow() {
+		return ctx, ErrRedisUnavailable
+	}
+	return ctx, nil
+}
+
+func (b *circuitBreaker) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	b.record(cmd.Err())
+	return nil
+}
+
+func (b *circuitBreaker) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if !b.allow() {
+		return ctx, ErrRedisUnavailable
+	}
+	return ctx, nil
+}
+
+func (b *circuitBreaker) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if Unavailable(cmd.Err()) {
+			err = cmd.Err()
+			break
+		}
+	}
+	b.record(err)
+	return nil
+}
+
+// Unavailable reports whether err means Redis could not be reached, as opposed to a reply such as a
+// missing key or a script error
+func Unavailable(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var reply redis.Error
+	return !errors.As(err, &reply)
+}
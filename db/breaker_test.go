@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// replyError is an error reply from Redis, like a script error or WRONGTYPE
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError()     {}
+
+var errRefused = errors.New("dial tcp 127.0.0.1:6379: connect: connection refused")
+
+func TestUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"missing key", redis.Nil, false},
+		{"error reply", replyError("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{"canceled request", context.Canceled, false},
+		{"connection refused", errRefused, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"wrapped connection error", fmt.Errorf("error reading session: %w", errRefused), true},
+		{"breaker open", ErrRedisUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unavailable(tt.err); got != tt.want {
+				t.Fatalf("Unavailable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailsOpen(t *testing.T) {
+	for _, feature := range []string{FeatureRateLimit, FeatureRevocation, FeatureLockout, FeatureResend} {
+		if !FailsOpen(feature, errRefused) {
+			t.Errorf("%s fails closed by default", feature)
+		}
+	}
+	// Failing closed is an opt-in per feature
+	failOpen[FeatureRevocation] = false
+	defer func() { failOpen[FeatureRevocation] = true }()
+	if FailsOpen(FeatureRevocation, errRefused) || !FailsOpen(FeatureLockout, errRefused) {
+		t.Error("closing revocation did not close it alone")
+	}
+	// Only an unreachable Redis is a reason to carry on
+	if FailsOpen(FeatureRateLimit, replyError("ERR script")) {
+		t.Error("failed open on an error reply")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	recovered := make(chan struct{}, 1)
+	b := &circuitBreaker{threshold: 3, cooldown: time.Hour, onRecover: func() { recovered <- struct{}{} }}
+
+	// Error replies and the breaker's own rejections are not failures
+	b.record(errRefused)
+	b.record(replyError("ERR script"))
+	b.record(errRefused)
+	b.record(errRefused)
+	b.record(ErrRedisUnavailable)
+	if b.isOpen() {
+		t.Fatal("opened before threshold consecutive failures")
+	}
+
+	b.record(errRefused)
+	if !b.isOpen() || b.allow() {
+		t.Fatal("still sending commands after threshold failures")
+	}
+
+	// After the cooldown one probe goes through; a failed probe waits another cooldown
+	b.probeAt = time.Now()
+	if !b.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second probe within the cooldown")
+	}
+	b.record(errRefused)
+	if !b.isOpen() || b.allow() {
+		t.Fatal("failed probe closed the breaker")
+	}
+
+	b.probeAt = time.Now()
+	if !b.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.record(redis.Nil)
+	if b.isOpen() || !b.allow() {
+		t.Fatal("successful probe left the breaker open")
+	}
+	select {
+	case <-recovered:
+	case <-time.After(time.Second):
+		t.Fatal("onRecover did not run")
+	}
+
+	b.trip()
+	if !b.isOpen() {
+		t.Fatal("trip did not open the breaker")
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	c := newLocalCache(2)
+	c.set("file:1", "one", time.Minute)
+	c.set("file:2", "two", time.Minute)
+	if v, ok := c.get("file:1"); !ok || v != "one" {
+		t.Fatalf("get(file:1) = %q, %v", v, ok)
+	}
+
+	// file:2 is now the least recently used
+	c.set("file:3", "three", time.Minute)
+	if _, ok := c.get("file:2"); ok {
+		t.Error("least recently used entry survived")
+	}
+	if _, ok := c.get("file:1"); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	c.set("file:1", "uno", -time.Second)
+	if _, ok := c.get("file:1"); ok {
+		t.Error("expired entry returned")
+	}
+
+	tests := []struct {
+		pattern string
+		keys    []string
+		kept    []string
+	}{
+		{"file:*", []string{"file:1", "file:10"}, nil},
+		{"file:?", []string{"file:1", "file:10"}, []string{"file:10"}},
+		{"search:7:*", []string{"search:7:a", "search:71:a"}, []string{"search:71:a"}},
+		{"file:[1]", []string{"file:1", "file:[1]"}, []string{"file:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			c := newLocalCache(10)
+			for _, key := range tt.keys {
+				c.set(key, "v", time.Minute)
+			}
+			c.deleteMatching(tt.pattern)
+			if len(c.entries) != len(tt.kept) {
+				t.Fatalf("%d entries left, want %v", len(c.entries), tt.kept)
+			}
+			for _, key := range tt.kept {
+				if _, ok := c.get(key); !ok {
+					t.Errorf("%s deleted", key)
+				}
+			}
+		})
+	}
+
+	disabled := newLocalCache(0)
+	disabled.set("file:1", "one", time.Minute)
+	if _, ok := disabled.get("file:1"); ok {
+		t.Error("cache of size 0 stored an entry")
+	}
+}
+
+func TestInvalidateCacheWithoutRedis(t *testing.T) {
+	// Programs that never connected Redis, like the worker used to, only have the local cache
+	client := RedisClient
+	RedisClient = nil
+	defer func() { RedisClient = client }()
+
+	fallbackCache.set("file:1", "one", time.Minute)
+	if err := InvalidateCache("file:*"); err != nil {
+		t.Fatalf("InvalidateCache = %v", err)
+	}
+	if _, ok := fallbackCache.get("file:1"); ok {
+		t.Error("local entry survived the invalidation")
+	}
+}
@@ -4,30 +4,18 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"shareit/config"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 )
 
 var DB *sql.DB
 
 // ConnectDB initializes the MySQL database connection
-func ConnectDB() {
+func ConnectDB(cfg *config.Config) {
     var err error
-    err = godotenv.Load()
-    if err != nil {
-        log.Println("No .env file found, continuing...")
-    }
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", cfg.DBUser, cfg.DBPassword, cfg.DBHost, cfg.DBName)
 
-    
-    dbUser := os.Getenv("DB_USER")
-    dbPassword := os.Getenv("DB_PASSWORD")
-    dbName := os.Getenv("DB_NAME")
-    dbHost := os.Getenv("DB_HOST")
-    
-    dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPassword, dbHost, dbName)
-    
     DB, err = sql.Open("mysql", dsn)
     if err != nil {
         log.Fatal("Could not connect to MySQL database: ", err)
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"container/list"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCache is a bounded in-process LRU cache with expiring entries. It stands in for the Redis
+// cache while Redis is unavailable; being local to one instance it is never the only copy of
+// anything.
+type localCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type localEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newLocalCache(size int) *localCache {
+	return &localCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *localCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*localEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *localCache) set(key, value string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*localEntry)
+		entry.value = value
+		entry.expires = time.Now().Add(ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&localEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*localEntry).key)
+	}
+}
+
+// deleteMatching removes the entries whose key matches pattern. Of Redis's glob syntax only * and ?
+// are supported, which is all InvalidateCache callers use.
+func (c *localCache) deleteMatching(pattern string) {
+	glob := regexp.QuoteMeta(pattern)
+	glob = strings.ReplaceAll(glob, `\*`, ".*")
+	glob = strings.ReplaceAll(glob, `\?`, ".")
+	re := regexp.MustCompile("^" + glob + "$")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if re.MatchString(key) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *localCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// schemaColumn is a column of the current schema that tables created by an older init.sql lack.
+// init.sql only uses CREATE TABLE IF NOT EXISTS, so it never changes a table that already exists.
+type schemaColumn struct {
+	table, column, definition string
+	// backfill runs once, right after the column was added
+	backfill string
+}
+
+var schemaColumns = []schemaColumn{
+	{table: "users", column: "role", definition: "ENUM('user', 'admin', 'auditor') NOT NULL DEFAULT 'user'"},
+	{table: "users", column: "suspended_at", definition: "DATETIME NULL"},
+	// Accounts predating email verification were never asked to verify; do not lock them out now
+	{table: "users", column: "email_verified_at", definition: "DATETIME NULL",
+		backfill: "UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL"},
+	{table: "users", column: "totp_secret", definition: "VARBINARY(512) NULL"},
+	{table: "users", column: "totp_key_id", definition: "VARCHAR(64) NULL"},
+	{table: "users", column: "totp_enabled_at", definition: "DATETIME NULL"},
+	{table: "users", column: "totp_last_step", definition: "BIGINT NULL"},
+	{table: "users", column: "quota_bytes", definition: "BIGINT NULL"},
+	{table: "users", column: "quota_files", definition: "INT NULL"},
+	{table: "users", column: "used_bytes", definition: "BIGINT NOT NULL DEFAULT 0"},
+	{table: "users", column: "used_files", definition: "INT NOT NULL DEFAULT 0"},
+	{table: "files", column: "folder_id", definition: "INT NULL, ADD FOREIGN KEY (folder_id) REFERENCES folders(id)"},
+	{table: "files", column: "current_version_id", definition: "INT NULL, ADD INDEX (current_version_id)"},
+	{table: "files", column: "updated_at", definition: "TIMESTAMP DEFAULT CURRENT_TIMESTAMP",
+		backfill: "UPDATE files SET updated_at = created_at"},
+	{table: "files", column: "deleted_at", definition: "DATETIME NULL, ADD INDEX (deleted_at)"},
+	{table: "files", column: "deleted_by", definition: "INT NULL"},
+}
+
+// ColumnExists reports whether table has column in the connected database
+func ColumnExists(ctx context.Context, table, column string) (bool, error) {
+	var n int
+	err := DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&n)
+	return n > 0, err
+}
+
+// UpgradeSchema adds the columns of the current schema to tables created by an older init.sql. The
+// tables that did not exist then (folders, blobs, file_versions, ...) must have been created by
+// running the current init.sql first. Columns that exist already are left alone, so it can run
+// any number of times.
+func UpgradeSchema(ctx context.Context) error {
+	for _, table := range []string{"folders", "blobs", "file_versions"} {
+		var n int
+		err := DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, table).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("table %s is missing; run init.sql before migrating", table)
+		}
+	}
+
+	for _, c := range schemaColumns {
+		exists, err := ColumnExists(ctx, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := DB.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("error adding %s.%s: %w", c.table, c.column, err)
+		}
+		if c.backfill != "" {
+			if _, err := DB.ExecContext(ctx, c.backfill); err != nil {
+				return fmt.Errorf("error filling %s.%s: %w", c.table, c.column, err)
+			}
+		}
+		log.Printf("Added column %s.%s", c.table, c.column)
+	}
+	return nil
+}
+
+// DropColumn removes a column that the current schema no longer has, if it is still there
+func DropColumn(ctx context.Context, table, column string) error {
+	exists, err := ColumnExists(ctx, table, column)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := DB.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column)); err != nil {
+		return fmt.Errorf("error dropping %s.%s: %w", table, column, err)
+	}
+	log.Printf("Dropped column %s.%s", table, column)
+	return nil
+}
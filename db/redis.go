@@ -2,8 +2,9 @@ package db
 
 import (
 	"context"
-	"crypto/tls"
 	"log"
+	"shareit/config"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -12,20 +13,90 @@ import (
 var RedisClient *redis.Client
 var Ctx = context.Background()
 
-// ConnectRedis initializes the Redis client connection
-func ConnectRedis() {
-	RedisClient = redis.NewClient(&redis.Options{
-		Addr:     "complete-feline-33196.upstash.io:6379", // Redis address
-		Password: "AYGsAAIjcDE2MmFmN2MwM2M2NzA0YWMzYjhhODM2N2MzMzgxMjhiN3AxMA", // Redis password
-		DB:       0, // use default DB
-		TLSConfig: &tls.Config{
-			InsecureSkipVerify: true, // Skip verification of server certificate (useful for self-signed certs, not recommended for production)
-		},
-	})
-
-	_, err := RedisClient.Ping(Ctx).Result()
+// Features whose behaviour while Redis is unavailable is set with REDIS_FAIL_POLICY. Failing open
+// keeps the feature working without Redis (or with an in-process stand-in), failing closed rejects
+// the requests that need it with 503.
+const (
+	// FeatureRateLimit open: per-instance in-memory limits
+	FeatureRateLimit = "ratelimit"
+	// FeatureRevocation open: access tokens are only checked against the revocations made by the
+	// same instance; revoked refresh tokens stay revoked in MySQL
+	FeatureRevocation = "revocation"
+	// FeatureLockout open: failed logins are counted and locked out per instance
+	FeatureLockout = "lockout"
+	// FeatureResend open: verification mails are not throttled per address
+	FeatureResend = "resend"
+)
+
+// Every feature has an in-process stand-in, so all fail open by default. Closing revocation turns
+// a Redis outage into an outage of every authenticated request.
+var failOpen = map[string]bool{
+	FeatureRateLimit:  true,
+	FeatureRevocation: true,
+	FeatureLockout:    true,
+	FeatureResend:     true,
+}
+
+// FailsOpen reports whether feature should carry on after err, which is the case when Redis is
+// unavailable and the feature's policy is open
+func FailsOpen(feature string, err error) bool {
+	return Unavailable(err) && failOpen[feature]
+}
+
+var (
+	breaker = &circuitBreaker{threshold: 5, cooldown: 10 * time.Second, onRecover: recoverCache}
+
+	// fallbackCache serves cached metadata while Redis is unavailable. Other instances cannot
+	// invalidate it, so its entries live shorter than those in Redis.
+	fallbackCache    = newLocalCache(1000)
+	fallbackCacheTTL = time.Minute
+
+	// pendingInvalidations are patterns that could not be invalidated in Redis; they are replayed
+	// once it is back so that no stale entries survive the outage
+	pendingMu            sync.Mutex
+	pendingInvalidations = map[string]bool{}
+)
+
+// RedisAvailable reports whether the circuit breaker lets commands through to Redis
+func RedisAvailable() bool {
+	return !breaker.isOpen()
+}
+
+// ConnectRedis initializes the Redis client connection from REDIS_URL. An unreachable Redis is not fatal: the server
+// starts with the circuit breaker open and picks Redis up once it answers. The breaker, the fallback
+// cache and the fail policy of the degraded mode are taken from cfg.
+func ConnectRedis(cfg *config.Config) {
+	breaker.threshold = cfg.RedisBreakerThreshold
+	breaker.cooldown = cfg.RedisBreakerCooldown
+	fallbackCache = newLocalCache(cfg.RedisFallbackCacheSize)
+	for feature, open := range cfg.RedisFailPolicy {
+		failOpen[feature] = open
+	}
+	if !failOpen[FeatureRevocation] {
+		log.Println("WARNING: REDIS_FAIL_POLICY lets revocation fail closed; while Redis is down every authenticated request is answered with 503")
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
 	if err != nil {
-		log.Fatal("Could not connect to Redis:", err)
+		log.Fatal("Invalid REDIS_URL: ", err)
+	}
+	if opts.TLSConfig != nil && cfg.RedisTLSInsecure {
+		// Only for self-signed certificates in development
+		opts.TLSConfig.InsecureSkipVerify = true
+	}
+	// Fail fast, so that requests do not hang on a Redis that is down
+	opts.DialTimeout = 2 * time.Second
+	opts.ReadTimeout = time.Second
+	opts.WriteTimeout = time.Second
+
+	RedisClient = redis.NewClient(opts)
+	RedisClient.AddHook(breaker)
+
+	_, err = RedisClient.Ping(Ctx).Result()
+	if err != nil {
+		log.Println("Could not connect to Redis, continuing with the circuit breaker open:", err)
+		breaker.trip()
+		return
 	}
 
 	log.Println("Connected to Redis successfully!")
@@ -33,9 +104,65 @@ func ConnectRedis() {
 
 // CacheFileMetadata caches file metadata
 func CacheFileMetadata(fileID string, metadata string) error {
-    return RedisClient.Set(Ctx, fileID, metadata, 10*time.Minute).Err()
+	err := RedisClient.Set(Ctx, fileID, metadata, 10*time.Minute).Err()
+	if Unavailable(err) {
+		fallbackCache.set(fileID, metadata, fallbackCacheTTL)
+		return nil
+	}
+	return err
 }
 
 func GetCachedFileMetadata(fileID string) (string, error) {
-    return RedisClient.Get(Ctx, fileID).Result()
+	metadata, err := RedisClient.Get(Ctx, fileID).Result()
+	if Unavailable(err) {
+		if cached, ok := fallbackCache.get(fileID); ok {
+			return cached, nil
+		}
+	}
+	return metadata, err
+}
+
+// InvalidateCache deletes every cached entry whose key matches pattern (Redis glob syntax)
+func InvalidateCache(pattern string) error {
+	fallbackCache.deleteMatching(pattern)
+
+	err := invalidateRedis(pattern)
+	if Unavailable(err) {
+		pendingMu.Lock()
+		pendingInvalidations[pattern] = true
+		pendingMu.Unlock()
+		return nil
+	}
+	return err
+}
+
+func invalidateRedis(pattern string) error {
+	// Programs that never connected Redis have only the local cache
+	if RedisClient == nil {
+		return nil
+	}
+	iter := RedisClient.Scan(Ctx, 0, pattern, 100).Iterator()
+	for iter.Next(Ctx) {
+		if err := RedisClient.Del(Ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// recoverCache runs when Redis is back: entries cached locally during the outage may have been
+// invalidated on other instances, and Redis may hold entries invalidated during it
+func recoverCache() {
+	fallbackCache.clear()
+
+	pendingMu.Lock()
+	patterns := pendingInvalidations
+	pendingInvalidations = map[string]bool{}
+	pendingMu.Unlock()
+
+	for pattern := range patterns {
+		if err := InvalidateCache(pattern); err != nil {
+			log.Println("Error replaying cache invalidation:", err)
+		}
+	}
 }
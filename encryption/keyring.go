@@ -0,0 +1,273 @@
+package encryption
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyringReloadInterval is how often a file-backed keyring checks whether its file changed. A key
+// added by "shareit keys rotate" is in use by every server at most this long after the rotation.
+const KeyringReloadInterval = 5 * time.Second
+
+// Keyring is a KeyProvider holding versioned master keys loaded from a file or the environment
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+	path    string
+	list    string
+	pinned  bool
+	// checkedAt is when the file was last checked for changes; modTime and size are its state
+	// when it was last read
+	checkedAt time.Time
+	modTime   time.Time
+	size      int64
+}
+
+// LoadKeyring reads master keys from path (one "id=base64key" per line, "#" starts a comment)
+// or from list ("id:base64key,id:base64key"), not both: a key from the list would silently become
+// current over the newest key in the file. The current key is currentID, or the last key listed.
+func LoadKeyring(path, list, currentID string) (*Keyring, error) {
+	if path != "" && list != "" {
+		return nil, errors.New("set either MASTER_KEYS_FILE or MASTER_KEYS, not both")
+	}
+	return readKeyring(path, list, currentID)
+}
+
+func readKeyring(path, list, currentID string) (*Keyring, error) {
+	k := &Keyring{keys: map[string][]byte{}, path: path, list: list, checkedAt: time.Now()}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		k.modTime, k.size = info.ModTime(), info.Size()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			id, encoded, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid keyring line %q", line)
+			}
+			if err := k.add(strings.TrimSpace(id), strings.TrimSpace(encoded)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if list != "" {
+		for _, entry := range strings.Split(list, ",") {
+			id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid MASTER_KEYS entry %q", entry)
+			}
+			if err := k.add(id, encoded); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(k.keys) == 0 {
+		return nil, errors.New("no master keys configured (set MASTER_KEYS_FILE or MASTER_KEYS)")
+	}
+	if currentID != "" {
+		if _, ok := k.keys[currentID]; !ok {
+			return nil, fmt.Errorf("current master key %q is not in the keyring", currentID)
+		}
+		k.current = currentID
+		k.pinned = true
+	}
+	return k, nil
+}
+
+func (k *Keyring) add(id, encoded string) error {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("master key %q is not valid base64: %w", id, err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("master key %q must be 32 bytes, got %d", id, len(key))
+	}
+	if id == "" || len(id) > 64 {
+		return fmt.Errorf("invalid master key id %q", id)
+	}
+	k.keys[id] = key
+	k.current = id
+	return nil
+}
+
+// refresh re-reads the keyring file if it changed since it was read, checking at most once per
+// KeyringReloadInterval, so that a server picks up keys added by "shareit keys rotate" in another
+// process: both to unwrap data keys wrapped under them and to wrap new data keys under the new
+// current key.
+func (k *Keyring) refresh() {
+	if k.path == "" {
+		return
+	}
+	k.mu.RLock()
+	due := time.Since(k.checkedAt) >= KeyringReloadInterval
+	k.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.checkedAt) < KeyringReloadInterval {
+		// Another request checked in the meantime
+		return
+	}
+	k.checkedAt = time.Now()
+	info, err := os.Stat(k.path)
+	if err != nil {
+		log.Println("Error checking master keyring:", err)
+		return
+	}
+	if info.ModTime().Equal(k.modTime) && info.Size() == k.size {
+		return
+	}
+
+	currentID := ""
+	if k.pinned {
+		currentID = k.current
+	}
+	fresh, err := readKeyring(k.path, k.list, currentID)
+	if err != nil {
+		log.Println("Error reloading master keyring:", err)
+		return
+	}
+	if fresh.current != k.current {
+		log.Println("Master keyring reloaded, current key", fresh.current)
+	}
+	k.keys, k.current = fresh.keys, fresh.current
+	k.modTime, k.size = fresh.modTime, fresh.size
+}
+
+// master returns the key keyID, re-reading the keyring if it is unknown and the file changed
+func (k *Keyring) master(keyID string) ([]byte, bool) {
+	k.mu.RLock()
+	key, ok := k.keys[keyID]
+	k.mu.RUnlock()
+	if ok {
+		return key, true
+	}
+	k.refresh()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok = k.keys[keyID]
+	return key, ok
+}
+
+// WrapKey seals dataKey with AES-GCM under the current master key, binding the key id as additional data
+func (k *Keyring) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	k.refresh()
+	k.mu.RLock()
+	current := k.current
+	key := k.keys[current]
+	k.mu.RUnlock()
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(current)), current, nil
+}
+
+// UnwrapKey opens a data key wrapped under master key keyID
+func (k *Keyring) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	master, ok := k.master(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(keyID))
+}
+
+// CurrentKeyID returns the id of the key new data keys are wrapped under
+func (k *Keyring) CurrentKeyID(ctx context.Context) (string, error) {
+	k.refresh()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, nil
+}
+
+// Rotate generates a new master key, appends it to the keyring file and makes it current.
+// Keys given only through MASTER_KEYS cannot be rotated because there is nowhere to persist them.
+func (k *Keyring) Rotate(ctx context.Context) (string, error) {
+	if k.path == "" {
+		return "", errors.New("rotation needs a file-backed keyring (MASTER_KEYS_FILE); add a key to MASTER_KEYS manually instead")
+	}
+	if k.pinned {
+		return "", errors.New("MASTER_KEY_ID pins the current key; unset it so the rotated key becomes current")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Pick the next free "vN" id
+	next := 1
+	for id := range k.keys {
+		if n, err := strconv.Atoi(strings.TrimPrefix(id, "v")); err == nil && strings.HasPrefix(id, "v") && n >= next {
+			next = n + 1
+		}
+	}
+	id := "v" + strconv.Itoa(next)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(f, "\n%s=%s\n", id, base64.StdEncoding.EncodeToString(key)); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	k.keys[id] = key
+	k.current = id
+	if info, err := os.Stat(k.path); err == nil {
+		k.modTime, k.size = info.ModTime(), info.Size()
+	}
+	return id, nil
+}
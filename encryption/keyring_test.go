@@ -0,0 +1,161 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodedKey(t *testing.T) string {
+	return base64.StdEncoding.EncodeToString(testKey(t))
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "master.keys")
+	os.WriteFile(file, []byte("# comment\nv1="+encodedKey(t)+"\n\nv2 = "+encodedKey(t)+"\n"), 0o600)
+
+	tests := []struct {
+		name        string
+		path, list  string
+		currentID   string
+		wantCurrent string
+		wantErr     string
+	}{
+		{"file, last key is current", file, "", "", "v2", ""},
+		{"file pinned", file, "", "v1", "v1", ""},
+		{"list", "", "a:" + encodedKey(t) + ",b:" + encodedKey(t), "", "b", ""},
+		{"file and list", file, "v9:" + encodedKey(t), "", "", "not both"},
+		{"nothing", "", "", "", "", "no master keys"},
+		{"unknown pinned key", file, "", "v3", "", "not in the keyring"},
+		{"short key", "", "v1:" + base64.StdEncoding.EncodeToString([]byte("short")), "", "", "must be 32 bytes"},
+		{"bad base64", "", "v1:***", "", "", "not valid base64"},
+		{"bad list entry", "", "v1", "", "", "invalid MASTER_KEYS entry"},
+		{"missing file", filepath.Join(dir, "missing"), "", "", "", "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := LoadKeyring(tt.path, tt.list, tt.currentID)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current, _ := k.CurrentKeyID(context.Background()); current != tt.wantCurrent {
+				t.Errorf("current key = %q, want %q", current, tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestKeyringWrapUnwrap(t *testing.T) {
+	ctx := context.Background()
+	k, err := LoadKeyring("", "v1:"+encodedKey(t)+",v2:"+encodedKey(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := testKey(t)
+	wrapped, keyID, err := k.WrapKey(ctx, dataKey)
+	if err != nil || keyID != "v2" {
+		t.Fatalf("WrapKey = %q, %v", keyID, err)
+	}
+
+	tests := []struct {
+		name    string
+		keyID   string
+		wrapped []byte
+		wantErr bool
+	}{
+		{"current key", "v2", wrapped, false},
+		{"other key id", "v1", wrapped, true},
+		{"unknown key id", "v3", wrapped, true},
+		{"tampered", "v2", append(append([]byte{}, wrapped[:len(wrapped)-1]...), wrapped[len(wrapped)-1]^1), true},
+		{"too short", "v2", wrapped[:4], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.UnwrapKey(ctx, tt.keyID, tt.wrapped)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("UnwrapKey succeeded")
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, dataKey) {
+				t.Fatalf("UnwrapKey = %x, %v", got, err)
+			}
+		})
+	}
+}
+
+// A server keeps unwrapping after another process rotated the keyring file
+func TestKeyringRotateAndReload(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "master.keys")
+	os.WriteFile(file, []byte("v1="+encodedKey(t)+"\n"), 0o600)
+
+	server, err := LoadKeyring(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator, err := LoadKeyring(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := operator.Rotate(ctx)
+	if err != nil || keyID != "v2" {
+		t.Fatalf("Rotate = %q, %v", keyID, err)
+	}
+	dataKey := make([]byte, DataKeySize)
+	rand.Read(dataKey)
+	wrapped, wrappedID, err := operator.WrapKey(ctx, dataKey)
+	if err != nil || wrappedID != "v2" {
+		t.Fatalf("WrapKey = %q, %v", wrappedID, err)
+	}
+
+	// The file is checked for changes at most once per KeyringReloadInterval
+	if _, err := server.UnwrapKey(ctx, "v2", wrapped); err == nil {
+		t.Fatal("unwrapped under a key added less than KeyringReloadInterval ago")
+	}
+	server.checkedAt = time.Now().Add(-KeyringReloadInterval)
+	got, err := server.UnwrapKey(ctx, "v2", wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("UnwrapKey after reload = %v", err)
+	}
+
+	// New data keys are wrapped under the rotated key without waiting for an unknown key id
+	rotated, err := LoadKeyring(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := operator.Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rotated.checkedAt = time.Now().Add(-KeyringReloadInterval)
+	if _, keyID, err := rotated.WrapKey(ctx, dataKey); err != nil || keyID != "v3" {
+		t.Errorf("WrapKey after rotation = %q, %v, want v3", keyID, err)
+	}
+	server.checkedAt = time.Now().Add(-KeyringReloadInterval)
+	if current, _ := server.CurrentKeyID(ctx); current != "v3" {
+		t.Errorf("current key after rotation = %q, want v3", current)
+	}
+
+	pinned, _ := LoadKeyring(file, "", "v1")
+	if _, err := pinned.Rotate(ctx); err == nil {
+		t.Error("rotated a keyring pinned with MASTER_KEY_ID")
+	}
+	inline, _ := LoadKeyring("", "v1:"+encodedKey(t), "")
+	if _, err := inline.Rotate(ctx); err == nil {
+		t.Error("rotated a keyring without a file")
+	}
+}
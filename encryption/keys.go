@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"shareit/config"
+)
+
+// DataKeySize is the size of the random per-file AES-256 data keys
+const DataKeySize = 32
+
+// KeyProvider wraps per-file data keys with a master key it manages. Master keys never leave
+// the provider; only wrapped data keys and the id of the master key version are stored.
+type KeyProvider interface {
+	// WrapKey encrypts dataKey under the current master key version and returns that version's id
+	WrapKey(ctx context.Context, dataKey []byte) (wrapped []byte, keyID string, err error)
+	// UnwrapKey decrypts a data key that was wrapped under the master key version keyID
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+	// CurrentKeyID returns the id of the master key version new data keys are wrapped under
+	CurrentKeyID(ctx context.Context) (string, error)
+	// Rotate introduces a new master key version and makes it current. Older versions stay
+	// available for unwrapping until every data key has been re-wrapped.
+	Rotate(ctx context.Context) (string, error)
+}
+
+// Rewrapper is implemented by providers that can move a wrapped key to the current master key
+// version without exposing the data key to the caller
+type Rewrapper interface {
+	RewrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, string, error)
+}
+
+// Keys is the provider selected by configuration in Connect
+var Keys KeyProvider
+
+// Connect initializes the key provider selected by cfg.KeyProvider ("keyring" or "vault")
+func Connect(cfg *config.Config) {
+	switch cfg.KeyProvider {
+	case "keyring":
+		keyring, err := LoadKeyring(cfg.MasterKeysFile, cfg.MasterKeys, cfg.MasterKeyID)
+		if err != nil {
+			log.Fatal("Could not load master keyring: ", err)
+		}
+		Keys = keyring
+		log.Println("Using master keyring, current key", keyring.current)
+	case "vault":
+		vault, err := NewVault(VaultConfig{
+			Addr:  cfg.VaultAddr,
+			Token: cfg.VaultToken,
+			Mount: cfg.VaultTransitMount,
+			Key:   cfg.VaultTransitKey,
+		})
+		if err != nil {
+			log.Fatal("Could not connect to Vault: ", err)
+		}
+		Keys = vault
+		log.Println("Using Vault transit key", vault.cfg.Key)
+	default:
+		log.Fatalf("Unknown KEY_PROVIDER %q", cfg.KeyProvider)
+	}
+}
+
+// NewDataKey generates a random data key and wraps it with the current master key
+func NewDataKey(ctx context.Context) (dataKey, wrapped []byte, keyID string, err error) {
+	dataKey = make([]byte, DataKeySize)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, keyID, err = Keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return dataKey, wrapped, keyID, nil
+}
+
+// RewrapKey re-wraps a data key under the current master key version
+func RewrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, string, error) {
+	if rewrapper, ok := Keys.(Rewrapper); ok {
+		return rewrapper.RewrapKey(ctx, keyID, wrapped)
+	}
+	dataKey, err := Keys.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, "", err
+	}
+	return Keys.WrapKey(ctx, dataKey)
+}
+
+// KeyFingerprint identifies a data key in stream headers without revealing it
+func KeyFingerprint(dataKey []byte) string {
+	sum := sha256.Sum256(dataKey)
+	return "dek:" + hex.EncodeToString(sum[:8])
+}
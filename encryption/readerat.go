@@ -0,0 +1,103 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ReaderAt gives random access to the plaintext of an encrypted stream. Only the segments that
+// cover a requested range are read and authenticated, so serving a byte range never requires
+// decrypting the whole file.
+type ReaderAt struct {
+	src    io.ReaderAt
+	aead   cipher.AEAD
+	header *Header
+	size   int64 // encrypted size
+	plain  int64 // plaintext size
+
+	mu       sync.Mutex
+	cacheIdx int64
+	cache    []byte
+}
+
+// NewReaderAt parses the header of the encrypted stream in src (size bytes long) and decrypts with key
+func NewReaderAt(src io.ReaderAt, size int64, key []byte) (*ReaderAt, error) {
+	header, err := ReadHeader(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := PlaintextSize(header, size)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{src: src, aead: aead, header: header, size: size, plain: plain, cacheIdx: -1}, nil
+}
+
+// Header returns the parsed stream header
+func (r *ReaderAt) Header() *Header {
+	return r.header
+}
+
+// Size returns the plaintext size
+func (r *ReaderAt) Size() int64 {
+	return r.plain
+}
+
+// ReadAt decrypts len(p) plaintext bytes starting at off
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("encryption: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.plain {
+			return n, io.EOF
+		}
+		idx := pos / int64(r.header.SegmentSize)
+		segment, err := r.segment(idx)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], segment[pos-idx*int64(r.header.SegmentSize):])
+	}
+	return n, nil
+}
+
+// segment returns the decrypted segment idx, keeping the last one cached for sequential reads
+func (r *ReaderAt) segment(idx int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if idx == r.cacheIdx {
+		return r.cache, nil
+	}
+
+	sealedSize := int64(r.header.SegmentSize) + tagSize
+	start := r.header.Len() + idx*sealedSize
+	end := start + sealedSize
+	final := end >= r.size
+	if final {
+		end = r.size
+	}
+	if idx > int64(^uint32(0)) {
+		return nil, errors.New("encryption: segment index out of range")
+	}
+
+	sealed := make([]byte, end-start)
+	if _, err := r.src.ReadAt(sealed, start); err != nil && !(err == io.EOF && final) {
+		return nil, err
+	}
+	plain, err := r.aead.Open(sealed[:0], segmentNonce(r.header, uint32(idx), final), sealed, r.header.raw)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: segment %d failed authentication: %w", idx, err)
+	}
+	r.cacheIdx, r.cache = idx, plain
+	return plain, nil
+}
@@ -0,0 +1,288 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stream format (version 1)
+//
+//	header:  magic "SHEN" | version (1) | key id length (1) | key id | segment size (uint32 BE) | nonce prefix (7)
+//	body:    one or more AES-256-GCM sealed segments of SegmentSize plaintext bytes (the last one may be shorter)
+//
+// Every segment is sealed with the nonce  prefix | segment index (uint32 BE) | final flag (1 byte)
+// and the full header as additional data, so segments cannot be reordered, dropped from the end,
+// or moved between files, and a stream cut at a segment boundary fails to authenticate.
+const (
+	Version1           = 1
+	DefaultSegmentSize = 64 * 1024
+
+	noncePrefixSize = 7
+	tagSize         = 16
+)
+
+var magic = []byte("SHEN")
+
+var (
+	// ErrInvalidHeader is returned when a stream does not start with a valid header
+	ErrInvalidHeader = errors.New("encryption: invalid stream header")
+	// ErrTruncated is returned when a stream ends before its final segment
+	ErrTruncated = errors.New("encryption: stream truncated")
+)
+
+// Header is the plaintext header at the start of every encrypted stream
+type Header struct {
+	Version     byte
+	KeyID       string
+	SegmentSize uint32
+	NoncePrefix [noncePrefixSize]byte
+
+	raw []byte
+}
+
+// Len returns the encoded length of the header in bytes
+func (h *Header) Len() int64 {
+	return int64(len(h.raw))
+}
+
+func (h *Header) encode() {
+	buf := append([]byte{}, magic...)
+	buf = append(buf, h.Version, byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = binary.BigEndian.AppendUint32(buf, h.SegmentSize)
+	h.raw = append(buf, h.NoncePrefix[:]...)
+}
+
+// ReadHeader parses the stream header from r
+func ReadHeader(r io.Reader) (*Header, error) {
+	fixed := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if string(fixed[:len(magic)]) != string(magic) || fixed[len(magic)] != Version1 {
+		return nil, ErrInvalidHeader
+	}
+
+	rest := make([]byte, int(fixed[len(magic)+1])+4+noncePrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	keyIDLen := int(fixed[len(magic)+1])
+	h := &Header{
+		Version:     fixed[len(magic)],
+		KeyID:       string(rest[:keyIDLen]),
+		SegmentSize: binary.BigEndian.Uint32(rest[keyIDLen:]),
+	}
+	copy(h.NoncePrefix[:], rest[keyIDLen+4:])
+	if h.SegmentSize == 0 {
+		return nil, ErrInvalidHeader
+	}
+	h.raw = append(fixed, rest...)
+	return h, nil
+}
+
+// PlaintextSize returns the size of the decrypted content of a stream whose total encrypted size is size
+func PlaintextSize(h *Header, size int64) (int64, error) {
+	body := size - h.Len()
+	segment := int64(h.SegmentSize) + tagSize
+	if body < tagSize {
+		return 0, ErrTruncated
+	}
+	full := (body - 1) / segment
+	last := body - full*segment
+	if last < tagSize {
+		return 0, ErrTruncated
+	}
+	return full*int64(h.SegmentSize) + last - tagSize, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(h *Header, index uint32, final bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, h.NoncePrefix[:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Writer encrypts everything written to it into the underlying writer.
+// Close must be called to seal the final segment; it does not close the underlying writer.
+type Writer struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	header *Header
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+// NewWriter writes a fresh header to dst and returns a Writer sealing segments with key
+func NewWriter(dst io.Writer, key []byte, keyID string) (*Writer, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("encryption: key id too long")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: Version1, KeyID: keyID, SegmentSize: DefaultSegmentSize}
+	if _, err := io.ReadFull(rand.Reader, h.NoncePrefix[:]); err != nil {
+		return nil, err
+	}
+	h.encode()
+	if _, err := dst.Write(h.raw); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		dst:    dst,
+		aead:   aead,
+		header: h,
+		buf:    make([]byte, 0, DefaultSegmentSize+tagSize),
+	}, nil
+}
+
+// Write buffers p, sealing a segment whenever a full one is followed by more data
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encryption: write to closed writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == int(w.header.SegmentSize) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.header.SegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the buffered data as the final segment
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *Writer) flush(final bool) error {
+	if w.index == ^uint32(0) {
+		return errors.New("encryption: stream too long")
+	}
+	sealed := w.aead.Seal(w.buf[:0], segmentNonce(w.header, w.index, final), w.buf, w.header.raw)
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// Reader decrypts a stream produced by Writer, authenticating each segment before returning it
+type Reader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	header *Header
+	seg    []byte
+	plain  []byte
+	index  uint32
+	done   bool
+}
+
+// NewReader reads the header from src and returns a Reader decrypting with key
+func NewReader(src io.Reader, key []byte) (*Reader, error) {
+	header, err := ReadHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderWithHeader(src, header, key)
+}
+
+// NewReaderWithHeader decrypts the body of a stream whose header was already consumed with ReadHeader
+func NewReaderWithHeader(src io.Reader, header *Header, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		src:    bufio.NewReader(src),
+		aead:   aead,
+		header: header,
+		seg:    make([]byte, int(header.SegmentSize)+tagSize),
+	}, nil
+}
+
+// Header returns the parsed stream header
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+// Read returns decrypted plaintext
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the following segment. A short segment, or a full one at the end of
+// the input, must be the final one.
+func (r *Reader) next() error {
+	n, err := io.ReadFull(r.src, r.seg)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		final = true
+	case err == io.EOF:
+		return ErrTruncated
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return ErrTruncated
+	}
+
+	plain, err := r.aead.Open(r.seg[:0], segmentNonce(r.header, r.index, final), r.seg[:n], r.header.raw)
+	if err != nil {
+		return fmt.Errorf("encryption: segment %d failed authentication: %w", r.index, err)
+	}
+	r.plain = plain
+	r.index++
+	r.done = final
+	return nil
+}
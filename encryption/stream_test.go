@@ -0,0 +1,200 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encrypt returns plaintext of size bytes and its encrypted stream
+func encrypt(t *testing.T, key []byte, size int) ([]byte, []byte) {
+	t.Helper()
+	plain := make([]byte, size)
+	rand.Read(plain)
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, key, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes so that segments are filled across several writes
+	for rest := plain; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return plain, sealed.Bytes()
+}
+
+var streamSizes = []struct {
+	name string
+	size int
+}{
+	{"empty", 0},
+	{"one byte", 1},
+	{"just under a segment", DefaultSegmentSize - 1},
+	{"one segment", DefaultSegmentSize},
+	{"just over a segment", DefaultSegmentSize + 1},
+	{"several segments", 3*DefaultSegmentSize + 17},
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, tt := range streamSizes {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, sealed := encrypt(t, key, tt.size)
+
+			r, err := NewReader(bytes.NewReader(sealed), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Header().KeyID != "v1" {
+				t.Errorf("key id = %q, want v1", r.Header().KeyID)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("decrypted %d bytes, want the %d bytes written", len(got), len(plain))
+			}
+
+			size, err := PlaintextSize(r.Header(), int64(len(sealed)))
+			if err != nil || size != int64(tt.size) {
+				t.Errorf("PlaintextSize = %d, %v, want %d", size, err, tt.size)
+			}
+		})
+	}
+}
+
+func TestReaderAtRanges(t *testing.T) {
+	key := testKey(t)
+	plain, sealed := encrypt(t, key, 3*DefaultSegmentSize+17)
+	r, err := NewReaderAt(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(plain)) {
+		t.Fatalf("Size = %d, want %d", r.Size(), len(plain))
+	}
+
+	tests := []struct {
+		name     string
+		off, n   int
+		wantRead int
+		wantEOF  bool
+	}{
+		{"start", 0, 10, 10, false},
+		{"inside a segment", 100, 1000, 1000, false},
+		{"across a segment boundary", DefaultSegmentSize - 5, 10, 10, false},
+		{"across several segments", 10, 2*DefaultSegmentSize + 5, 2*DefaultSegmentSize + 5, false},
+		{"tail", len(plain) - 7, 7, 7, false},
+		{"past the end", len(plain) - 7, 20, 7, true},
+		{"at the end", len(plain), 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.n)
+			n, err := r.ReadAt(buf, int64(tt.off))
+			if n != tt.wantRead {
+				t.Fatalf("read %d bytes, want %d", n, tt.wantRead)
+			}
+			if (err == io.EOF) != tt.wantEOF || (err != nil && err != io.EOF) {
+				t.Fatalf("err = %v, want EOF %v", err, tt.wantEOF)
+			}
+			if !bytes.Equal(buf[:n], plain[tt.off:tt.off+n]) {
+				t.Fatal("decrypted range does not match the plaintext")
+			}
+		})
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := testKey(t)
+	_, sealed := encrypt(t, key, 3*DefaultSegmentSize+17)
+	header, err := ReadHeader(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hl := int(header.Len())
+	seg := DefaultSegmentSize + tagSize
+
+	segment := func(b []byte, i int) []byte { return b[hl+i*seg : hl+(i+1)*seg] }
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+		key    []byte
+	}{
+		{"truncated at a segment boundary", func(b []byte) []byte { return b[:hl+3*seg] }, key},
+		{"truncated inside a segment", func(b []byte) []byte { return b[:hl+seg+100] }, key},
+		{"truncated to the header", func(b []byte) []byte { return b[:hl] }, key},
+		{"segments reordered", func(b []byte) []byte {
+			first := append([]byte{}, segment(b, 0)...)
+			copy(segment(b, 0), segment(b, 1))
+			copy(segment(b, 1), first)
+			return b
+		}, key},
+		{"segment dropped", func(b []byte) []byte {
+			return append(append([]byte{}, b[:hl+seg]...), b[hl+2*seg:]...)
+		}, key},
+		{"bit flipped", func(b []byte) []byte { b[hl+seg+7] ^= 1; return b }, key},
+		{"header changed", func(b []byte) []byte { b[hl-1] ^= 1; return b }, key},
+		{"wrong key", func(b []byte) []byte { return b }, testKey(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.mutate(append([]byte{}, sealed...))
+
+			r, err := NewReader(bytes.NewReader(tampered), tt.key)
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Fatal("Reader accepted a tampered stream")
+			}
+
+			ra, err := NewReaderAt(bytes.NewReader(tampered), int64(len(tampered)), tt.key)
+			if err == nil {
+				_, err = io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+			}
+			if err == nil {
+				t.Fatal("ReaderAt accepted a tampered stream")
+			}
+		})
+	}
+}
+
+func TestReadHeaderRejectsGarbage(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", []byte("NOPE\x01\x00\x00\x01\x00\x00abcdefg")},
+		{"wrong version", []byte("SHEN\x02\x00\x00\x01\x00\x00abcdefg")},
+		{"short", []byte("SHEN\x01\x02v")},
+		{"zero segment size", []byte("SHEN\x01\x00\x00\x00\x00\x00abcdefg")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(tt.data)); !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("err = %v, want ErrInvalidHeader", err)
+			}
+		})
+	}
+}
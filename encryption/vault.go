@@ -0,0 +1,159 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultConfig holds the settings for the HashiCorp Vault transit secrets engine
+type VaultConfig struct {
+	Addr  string // e.g. "http://127.0.0.1:8200" for a local "vault server -dev"
+	Token string
+	Mount string // transit mount path, "transit" by default
+	Key   string // name of the transit key
+}
+
+// Vault is a KeyProvider that wraps data keys with a Vault transit key, so master keys never leave Vault
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+// NewVault validates the configuration and checks that the transit key is reachable
+func NewVault(cfg VaultConfig) (*Vault, error) {
+	if cfg.Addr == "" || cfg.Token == "" || cfg.Key == "" {
+		return nil, errors.New("VAULT_ADDR, VAULT_TOKEN and VAULT_TRANSIT_KEY are required")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "transit"
+	}
+	cfg.Addr = strings.TrimRight(cfg.Addr, "/")
+	v := &Vault{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+
+	if err := v.call(context.Background(), http.MethodGet, "keys/"+cfg.Key, nil, nil); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// call sends a request to the transit engine and decodes the "data" object of the response into out
+func (v *Vault) call(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.cfg.Addr+"/v1/"+v.cfg.Mount+"/"+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("vault %s %s: %s %s", method, path, resp.Status, strings.Join(failure.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(&struct {
+		Data interface{} `json:"data"`
+	}{Data: out})
+}
+
+// vaultKeyID extracts the key version prefix ("vault:v3") from a transit ciphertext
+func vaultKeyID(ciphertext string) (string, error) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return "", fmt.Errorf("unexpected transit ciphertext format")
+	}
+	return parts[0] + ":" + parts[1], nil
+}
+
+// WrapKey encrypts dataKey with the latest version of the transit key
+func (v *Vault) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	var result struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call(ctx, http.MethodPost, "encrypt/"+v.cfg.Key,
+		map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	keyID, err := vaultKeyID(result.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(result.Ciphertext), keyID, nil
+}
+
+// UnwrapKey decrypts a transit ciphertext; Vault resolves the key version from the ciphertext itself
+func (v *Vault) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	var result struct {
+		Plaintext string `json:"plaintext"`
+	}
+	err := v.call(ctx, http.MethodPost, "decrypt/"+v.cfg.Key,
+		map[string]string{"ciphertext": string(wrapped)}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Plaintext)
+}
+
+// CurrentKeyID returns the id of the latest transit key version, e.g. "vault:v3"
+func (v *Vault) CurrentKeyID(ctx context.Context) (string, error) {
+	var result struct {
+		LatestVersion int `json:"latest_version"`
+	}
+	if err := v.call(ctx, http.MethodGet, "keys/"+v.cfg.Key, nil, &result); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vault:v%d", result.LatestVersion), nil
+}
+
+// Rotate asks Vault to create a new version of the transit key
+func (v *Vault) Rotate(ctx context.Context) (string, error) {
+	if err := v.call(ctx, http.MethodPost, "keys/"+v.cfg.Key+"/rotate", nil, nil); err != nil {
+		return "", err
+	}
+	return v.CurrentKeyID(ctx)
+}
+
+// RewrapKey moves a transit ciphertext to the latest key version inside Vault
+func (v *Vault) RewrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, string, error) {
+	var result struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := v.call(ctx, http.MethodPost, "rewrap/"+v.cfg.Key,
+		map[string]string{"ciphertext": string(wrapped)}, &result)
+	if err != nil {
+		return nil, "", err
+	}
+	newKeyID, err := vaultKeyID(result.Ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(result.Ciphertext), newKeyID, nil
+}
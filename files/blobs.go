@@ -0,0 +1,203 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"shareit/config"
+	"shareit/db"
+	"shareit/storage"
+	"time"
+)
+
+// Deduplication scopes. With "user" an upload only shares a blob with earlier uploads of the same
+// user, so nobody can learn anything about other users' files. "global" shares blobs between all
+// users and "off" stores every upload separately.
+const (
+	DedupUser   = "user"
+	DedupGlobal = "global"
+	DedupOff    = "off"
+)
+
+var dedupScope = DedupUser
+
+// InitDeduplication takes the deduplication scope from cfg
+func InitDeduplication(cfg *config.Config) {
+	dedupScope = cfg.DedupScope
+}
+
+// blob is an encrypted object in the storage backend together with its wrapped data key. Blobs
+// are content-addressed: file versions with the same plaintext in the same scope share one blob.
+type blob struct {
+	ID          int
+	ContentHash string
+	ObjectKey   string
+	WrappedKey  []byte
+	KeyID       string
+	Size        int64
+}
+
+// hashingReader computes the SHA-256 and length of everything read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (c *hashingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// Sum returns the hex content hash once the reader has been drained
+func (c *hashingReader) Sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// newObjectKey returns a fresh, unique object key for a blob uploaded by userID
+func newObjectKey(userID int) (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s.enc", userID, hex.EncodeToString(id)), nil
+}
+
+// blobScope is the namespace uploads of userID are deduplicated in
+func blobScope(userID int) string {
+	if dedupScope == DedupGlobal {
+		return DedupGlobal
+	}
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// claimBlob takes a reference on the blob with b's content in the uploader's scope. If there is
+// none, b itself is recorded with one reference. The returned blob is the one to use; when its
+// object key differs from b's, the freshly written b is redundant and must be deleted by the caller.
+func claimBlob(ctx context.Context, tx *sql.Tx, userID int, b blob) (blob, error) {
+	// Without deduplication the hash is left NULL, which never collides in the unique key
+	var contentHash interface{}
+	if dedupScope != DedupOff {
+		contentHash = b.ContentHash
+	}
+
+	// An existing blob gets its reference count bumped and its id reported through LAST_INSERT_ID
+	result, err := tx.ExecContext(ctx, `INSERT INTO blobs (scope, content_hash, object_key, wrapped_key, key_id, size, ref_count, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?)
+		ON DUPLICATE KEY UPDATE ref_count = ref_count + 1, id = LAST_INSERT_ID(id)`,
+		blobScope(userID), contentHash, b.ObjectKey, b.WrappedKey, b.KeyID, b.Size, time.Now())
+	if err != nil {
+		return blob{}, fmt.Errorf("error saving blob: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return blob{}, fmt.Errorf("error retrieving blob ID: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return blob{}, fmt.Errorf("error saving blob: %w", err)
+	}
+	if affected == 1 {
+		b.ID = int(id)
+		return b, nil
+	}
+
+	existing := blob{ID: int(id), ContentHash: b.ContentHash}
+	err = tx.QueryRowContext(ctx, "SELECT object_key, wrapped_key, key_id, size FROM blobs WHERE id = ?", id).
+		Scan(&existing.ObjectKey, &existing.WrappedKey, &existing.KeyID, &existing.Size)
+	if err != nil {
+		return blob{}, fmt.Errorf("error retrieving blob: %w", err)
+	}
+	return existing, nil
+}
+
+// retainBlob takes another reference on an existing blob
+func retainBlob(ctx context.Context, tx *sql.Tx, blobID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE id = ?", blobID)
+	if err != nil {
+		return fmt.Errorf("error referencing blob %d: %w", blobID, err)
+	}
+	return nil
+}
+
+// releaseBlob drops a reference; once the transaction commits, deleteBlob removes unreferenced blobs
+func releaseBlob(ctx context.Context, tx *sql.Tx, blobID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE blobs SET ref_count = ref_count - 1 WHERE id = ?", blobID)
+	if err != nil {
+		return fmt.Errorf("error releasing blob %d: %w", blobID, err)
+	}
+	return nil
+}
+
+// deleteBlob removes a blob from the database and the storage backend if nothing references it
+// anymore. The row goes first, so a concurrent upload of the same content records a new blob
+// instead of referencing one that is being deleted. A blob that is already gone is not an error.
+func deleteBlob(ctx context.Context, blobID int) error {
+	var objectKey string
+	err := db.DB.QueryRowContext(ctx, "SELECT object_key FROM blobs WHERE id = ? AND ref_count <= 0", blobID).Scan(&objectKey)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error retrieving blob %d: %w", blobID, err)
+	}
+
+	result, err := db.DB.ExecContext(ctx, "DELETE FROM blobs WHERE id = ? AND ref_count <= 0", blobID)
+	if err != nil {
+		return fmt.Errorf("error deleting blob %d: %w", blobID, err)
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		// Someone referenced the blob again in the meantime
+		return err
+	}
+
+	err = storage.Default.Delete(ctx, objectKey)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("error deleting file: %w", err)
+	}
+	return nil
+}
+
+// CollectOrphanBlobs deletes blobs whose last reference went away without the blob being removed,
+// e.g. because the process stopped between the metadata and the storage delete
+func CollectOrphanBlobs(ctx context.Context) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, "SELECT id FROM blobs WHERE ref_count <= 0")
+	if err != nil {
+		return 0, fmt.Errorf("error querying unreferenced blobs: %w", err)
+	}
+	var blobIDs []int
+	for rows.Next() {
+		var blobID int
+		if err := rows.Scan(&blobID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning blob id: %w", err)
+		}
+		blobIDs = append(blobIDs, blobID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error querying unreferenced blobs: %w", err)
+	}
+
+	collected := 0
+	for _, blobID := range blobIDs {
+		if err := deleteBlob(ctx, blobID); err != nil {
+			log.Println(err)
+			continue
+		}
+		collected++
+	}
+	return collected, nil
+}
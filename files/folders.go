@@ -0,0 +1,498 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"shareit/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errFolderNotFound = errors.New("folder not found")
+	errInvalidName    = errors.New("name must be 1-255 characters and cannot contain '/'")
+	errNameTaken      = errors.New("an item with this name already exists in the folder")
+	errFolderCycle    = errors.New("a folder cannot be moved into itself or one of its subfolders")
+)
+
+// Folder is a node in a user's folder tree; a nil ParentID is the root
+type Folder struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	ParentID  *int      `json:"parent_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Breadcrumb is one step on the path from the root to a folder
+type Breadcrumb struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// writeFolderError maps folder validation errors to responses
+func writeFolderError(w http.ResponseWriter, err error) {
+	switch err {
+	case errFolderNotFound:
+		http.Error(w, "Folder not found", http.StatusNotFound)
+	case errInvalidName, errFolderCycle:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errNameTaken:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println("Error handling folder:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func validName(name string) bool {
+	return name != "" && len(name) <= 255 && !strings.Contains(name, "/") && name != "." && name != ".."
+}
+
+// checkFolderOwner returns errFolderNotFound unless folderID exists and belongs to userID
+func checkFolderOwner(ctx context.Context, folderID, userID int) error {
+	var ownerID int
+	err := db.DB.QueryRowContext(ctx, "SELECT user_id FROM folders WHERE id = ?", folderID).Scan(&ownerID)
+	if err == sql.ErrNoRows || (err == nil && ownerID != userID) {
+		return errFolderNotFound
+	}
+	return err
+}
+
+// checkFolderNameFree rejects a name already used by a sibling folder of the same owner
+func checkFolderNameFree(ctx context.Context, userID int, parentID *int, name string, exceptID int) error {
+	var count int
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM folders WHERE user_id = ? AND parent_id <=> ? AND name = ? AND id <> ?",
+		userID, parentID, name, exceptID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errNameTaken
+	}
+	return nil
+}
+
+// checkFileNameFree rejects a name already used by another live file in the same folder of the same
+// owner; uploads under that name would otherwise become versions of either file
+func checkFileNameFree(ctx context.Context, ownerID int, folderID *int, name string, exceptID int) error {
+	var count int
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM files WHERE user_id = ? AND folder_id <=> ? AND filename = ? AND deleted_at IS NULL AND id <> ?",
+		ownerID, folderID, name, exceptID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errNameTaken
+	}
+	return nil
+}
+
+// breadcrumbs walks from folderID up to the root
+func breadcrumbs(ctx context.Context, folderID int) ([]Breadcrumb, error) {
+	var path []Breadcrumb
+	current := sql.NullInt64{Int64: int64(folderID), Valid: true}
+	for current.Valid {
+		var crumb Breadcrumb
+		err := db.DB.QueryRowContext(ctx, "SELECT id, name, parent_id FROM folders WHERE id = ?", current.Int64).
+			Scan(&crumb.ID, &crumb.Name, &current)
+		if err != nil {
+			return nil, err
+		}
+		path = append([]Breadcrumb{crumb}, path...)
+	}
+	return path, nil
+}
+
+// descendantFolders returns folderID and every folder below it, parents before children
+func descendantFolders(ctx context.Context, folderID int) ([]int, error) {
+	all := []int{folderID}
+	for i := 0; i < len(all); i++ {
+		rows, err := db.DB.QueryContext(ctx, "SELECT id FROM folders WHERE parent_id = ?", all[i])
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			all = append(all, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+func folderParam(w http.ResponseWriter, value string) (int, bool) {
+	folderID, err := strconv.Atoi(value)
+	if err != nil || folderID <= 0 {
+		http.Error(w, "folder_id is required", http.StatusBadRequest)
+		return 0, false
+	}
+	return folderID, true
+}
+
+// CreateFolder creates a folder under parent_id, or at the root when parent_id is omitted
+func CreateFolder(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		Name     string `json:"name"`
+		ParentID *int   `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validName(req.Name) {
+		writeFolderError(w, errInvalidName)
+		return
+	}
+	if req.ParentID != nil {
+		if err := checkFolderOwner(r.Context(), *req.ParentID, userID); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+	}
+	if err := checkFolderNameFree(r.Context(), userID, req.ParentID, req.Name, 0); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	result, err := db.DB.Exec("INSERT INTO folders (user_id, parent_id, name) VALUES (?, ?, ?)", userID, req.ParentID, req.Name)
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	folderID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Folder{ID: int(folderID), UserID: userID, ParentID: req.ParentID, Name: req.Name, CreatedAt: time.Now()})
+}
+
+// RenameFolder changes a folder's name
+func RenameFolder(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		FolderID int    `json:"folder_id"`
+		Name     string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validName(req.Name) {
+		writeFolderError(w, errInvalidName)
+		return
+	}
+	if err := checkFolderOwner(r.Context(), req.FolderID, userID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	var parentID sql.NullInt64
+	if err := db.DB.QueryRow("SELECT parent_id FROM folders WHERE id = ?", req.FolderID).Scan(&parentID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	var parent *int
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		parent = &id
+	}
+	if err := checkFolderNameFree(r.Context(), userID, parent, req.Name, req.FolderID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE folders SET name = ? WHERE id = ?", req.Name, req.FolderID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Folder renamed successfully"})
+}
+
+// MoveFolder moves a folder (with everything below it) under parent_id, or to the root
+func MoveFolder(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		FolderID int  `json:"folder_id"`
+		ParentID *int `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := checkFolderOwner(r.Context(), req.FolderID, userID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	if req.ParentID != nil {
+		if err := checkFolderOwner(r.Context(), *req.ParentID, userID); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		// The new parent must not be the folder itself or lie below it
+		path, err := breadcrumbs(r.Context(), *req.ParentID)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		for _, crumb := range path {
+			if crumb.ID == req.FolderID {
+				writeFolderError(w, errFolderCycle)
+				return
+			}
+		}
+	}
+
+	var name string
+	if err := db.DB.QueryRow("SELECT name FROM folders WHERE id = ?", req.FolderID).Scan(&name); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	if err := checkFolderNameFree(r.Context(), userID, req.ParentID, name, req.FolderID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE folders SET parent_id = ? WHERE id = ?", req.ParentID, req.FolderID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Folder moved successfully"})
+}
+
+// DeleteFolder deletes a folder and its subfolders and moves every file in them to the trash,
+// the same as DeleteFile. Restored files come back in the root folder.
+func DeleteFolder(w http.ResponseWriter, r *http.Request, userID int) {
+	folderID, ok := folderParam(w, r.URL.Query().Get("folder_id"))
+	if !ok {
+		return
+	}
+	if err := checkFolderOwner(r.Context(), folderID, userID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	folders, err := descendantFolders(r.Context(), folderID)
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	// Files go to the trash; as their folders disappear, a restore puts them in the root folder
+	trashed := 0
+	for _, id := range folders {
+		rows, err := db.DB.Query("SELECT id FROM files WHERE folder_id = ?", id)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		var fileIDs []int
+		for rows.Next() {
+			var fileID int
+			if err := rows.Scan(&fileID); err == nil {
+				fileIDs = append(fileIDs, fileID)
+			}
+		}
+		rows.Close()
+
+		for _, fileID := range fileIDs {
+			moved, err := trashFile(r.Context(), fileID, userID, true)
+			if err != nil {
+				// Stop before deleting the folders so the remaining files stay reachable
+				log.Println("Error moving file in folder to trash:", err)
+				http.Error(w, "Error deleting folder contents", http.StatusInternalServerError)
+				return
+			}
+			if moved {
+				trashed++
+			}
+		}
+	}
+
+	// Children before parents, because of the parent_id foreign key
+	for i := len(folders) - 1; i >= 0; i-- {
+		if _, err := db.DB.Exec("DELETE FROM folders WHERE id = ?", folders[i]); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":         "Folder deleted successfully",
+		"folders_deleted": len(folders),
+		"files_trashed":   trashed,
+	})
+}
+
+// ListFolder returns the subfolders and files of a folder (the root when folder_id is omitted)
+// together with the breadcrumbs leading to it
+func ListFolder(w http.ResponseWriter, r *http.Request, userID int) {
+	var folderID *int
+	crumbs := []Breadcrumb{}
+	if value := r.URL.Query().Get("folder_id"); value != "" {
+		id, ok := folderParam(w, value)
+		if !ok {
+			return
+		}
+		if err := checkFolderOwner(r.Context(), id, userID); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		path, err := breadcrumbs(r.Context(), id)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		folderID, crumbs = &id, path
+	}
+
+	rows, err := db.DB.Query("SELECT id, user_id, parent_id, name, created_at FROM folders WHERE user_id = ? AND parent_id <=> ? ORDER BY name",
+		userID, folderID)
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	folders := []Folder{}
+	for rows.Next() {
+		var folder Folder
+		var parentID sql.NullInt64
+		var createdAtStr string
+		if err := rows.Scan(&folder.ID, &folder.UserID, &parentID, &folder.Name, &createdAtStr); err != nil {
+			rows.Close()
+			writeFolderError(w, err)
+			return
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			folder.ParentID = &id
+		}
+		folder.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		folders = append(folders, folder)
+	}
+	rows.Close()
+
+	rows, err = db.DB.Query("SELECT "+fileColumns+" FROM "+fileTables+" WHERE f.user_id = ? AND f.folder_id <=> ? AND f.deleted_at IS NULL ORDER BY f.filename",
+		userID, folderID)
+	if err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	defer rows.Close()
+	files := []File{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
+		file.Role = RoleOwner.String()
+		files = append(files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folder_id":   folderID,
+		"breadcrumbs": crumbs,
+		"folders":     folders,
+		"files":       files,
+	})
+}
+
+// RenameFile changes a file's name. Requires editor.
+func RenameFile(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		FileID   int    `json:"file_id"`
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Filename = strings.TrimSpace(req.Filename)
+	if !validName(req.Filename) {
+		writeFolderError(w, errInvalidName)
+		return
+	}
+	if !authorize(w, r, userID, req.FileID, RoleEditor) {
+		return
+	}
+
+	var ownerID int
+	var folderID *int
+	if err := db.DB.QueryRow("SELECT user_id, folder_id FROM files WHERE id = ?", req.FileID).Scan(&ownerID, &folderID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	if err := checkFileNameFree(r.Context(), ownerID, folderID, req.Filename, req.FileID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE files SET filename = ? WHERE id = ?", req.Filename, req.FileID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	invalidateSearchCache(r.Context(), req.FileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File renamed successfully"})
+}
+
+// MoveFile moves a file into one of its owner's folders, or to the root. Requires editor.
+func MoveFile(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		FileID   int  `json:"file_id"`
+		FolderID *int `json:"folder_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, userID, req.FileID, RoleEditor) {
+		return
+	}
+
+	// Folders belong to the file's owner, even when an editor moves the file
+	var ownerID int
+	var filename string
+	if err := db.DB.QueryRow("SELECT user_id, filename FROM files WHERE id = ?", req.FileID).Scan(&ownerID, &filename); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	if req.FolderID != nil {
+		if err := checkFolderOwner(r.Context(), *req.FolderID, ownerID); err != nil {
+			writeFolderError(w, err)
+			return
+		}
+	}
+	if err := checkFileNameFree(r.Context(), ownerID, req.FolderID, filename, req.FileID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	if _, err := db.DB.Exec("UPDATE files SET folder_id = ? WHERE id = ?", req.FolderID, req.FileID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	invalidateSearchCache(r.Context(), req.FileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File moved successfully"})
+}
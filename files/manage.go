@@ -1,27 +1,26 @@
 package files
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
 	"shareit/db"
 	"time"
-
-	"github.com/gorilla/mux"
 )
 
-
 func SearchFile(w http.ResponseWriter, r *http.Request, userID int) {
     fileID := r.URL.Query().Get("file_id")
     fileType := r.URL.Query().Get("file_type")
     fileName := r.URL.Query().Get("file_name")
-    filePath := r.URL.Query().Get("file_path")
+	folderID := r.URL.Query().Get("folder_id")
 
-    cacheKey := fmt.Sprintf("files:user:%d:file_id=%s:file_type=%s:file_name=%s:file_path=%s",
-        userID, fileID, fileType, fileName, filePath)
+	cacheKey := fmt.Sprintf("files:user:%d:file_id=%s:file_type=%s:file_name=%s:folder_id=%s",
+		userID, fileID, fileType, fileName, folderID)
 
     // Check if the results are cached
     cachedData, err := db.GetCachedFileMetadata(cacheKey)
@@ -32,25 +31,27 @@ func SearchFile(w http.ResponseWriter, r *http.Request, userID int) {
         return
     }
 
-    // If cache is missed, query the database
-    query := "SELECT id, filename, file_type, file_path, user_id, created_at FROM files WHERE user_id = ?"
-    args := []interface{}{userID}
+	// If cache is missed, query the database for files the user owns or has been given access to
+	query := "SELECT " + fileColumns + `, COALESCE(p.role, 'owner')
+        FROM ` + fileTables + ` LEFT JOIN file_permissions p ON p.file_id = f.id AND p.user_id = ?
+        WHERE (f.user_id = ? OR p.user_id IS NOT NULL) AND f.deleted_at IS NULL`
+	args := []interface{}{userID, userID}
 
     if fileID != "" {
-        query += " AND id = ?"
+		query += " AND f.id = ?"
         args = append(args, fileID)
     }
     if fileType != "" {
-        query += " AND file_type = ?"
+		query += " AND v.file_type = ?"
         args = append(args, fileType)
     }
     if fileName != "" {
-        query += " AND filename LIKE ?"
+		query += " AND f.filename LIKE ?"
         args = append(args, "%"+fileName+"%")
     }
-    if filePath != "" {
-        query += " AND file_path LIKE ?"
-        args = append(args, "%"+filePath+"%")
+	if folderID != "" {
+		query += " AND f.folder_id = ?"
+		args = append(args, folderID)
     }
 
     rows, err := db.DB.Query(query, args...)
@@ -62,15 +63,15 @@ func SearchFile(w http.ResponseWriter, r *http.Request, userID int) {
     defer rows.Close()
 
     var files []File
+	var role string
     for rows.Next() {
-        var file File
-        var createdAtStr string
-        if err := rows.Scan(&file.ID, &file.Filename, &file.FileType, &file.FilePath, &file.UserID, &createdAtStr); err != nil {
+		file, err := scanFile(rows, &role)
+		if err != nil {
             log.Println("Error scanning file:", err)
             http.Error(w, "Internal server error", http.StatusInternalServerError)
             return
         }
-        file.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		file.Role = role
         files = append(files, file)
     }
 
@@ -88,131 +89,154 @@ func SearchFile(w http.ResponseWriter, r *http.Request, userID int) {
     w.Write(jsonData)
 }
 
-func ShareFile(w http.ResponseWriter, r *http.Request, userID int) {
-    fileID := r.URL.Query().Get("file_id")
-    if fileID == "" {
-        http.Error(w, "file_id is required", http.StatusBadRequest)
-        return
-    }
-
-    // Check if the shareable URL is cached in Redis
-    cachedURL, err := db.GetCachedFileMetadata(fileID)
-    if err == nil {
-        // Cache hit: Return the cached URL
-        response := map[string]string{
-            "file_id": fileID,
-            "url":     cachedURL,
-        }
-        w.WriteHeader(http.StatusOK)
-        json.NewEncoder(w).Encode(response)
-        return
-    }
-
-    // If not found in cache, generate a new shareable URL
-    shareableURL := "http://localhost:8080/files/access/" + fileID
-
-    // Cache the generated shareable URL for future use (expires in 10 minutes)
-    err = db.CacheFileMetadata(fileID, shareableURL)
-    if err != nil {
-        log.Println("Error caching file metadata:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
-        return
-    }
-
-    // Return the new shareable URL
-    response := map[string]string{
-        "file_id": fileID,
-        "url":     shareableURL,
-    }
-    w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(response)
-}
-
-
-// ShareFile allows users to get the sharable URL of a file based on file_id
-func ServeFile(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    fileID := vars["file_id"]
-
-    // Get the encrypted file path from the database
-    var encryptedFilePath string
+// serveFile streams a decrypted file, honouring Range, If-Range and conditional requests (ETag /
+// Last-Modified) and HEAD. Only the segments covering the requested ranges are decrypted.
+// version selects an older version, 0 serves the current one. Callers must have authorized access to fileID.
+// claim, if set, is called once the response turns out to be a download (see countsAsDownload); if it
+// fails the client gets the error instead of the file.
+func serveFile(w http.ResponseWriter, r *http.Request, fileID int, version int, claim func() error) {
+	// Get the object key and wrapped data key of the encrypted blob from the database
+	query := `SELECT b.object_key, f.filename, v.file_type, b.wrapped_key, b.key_id, v.created_at
+        FROM files f JOIN file_versions v ON v.file_id = f.id JOIN blobs b ON b.id = v.blob_id
+        WHERE f.id = ? AND f.deleted_at IS NULL`
+	args := []interface{}{fileID}
+	if version == 0 {
+		query += " AND v.id = f.current_version_id"
+	} else {
+		query += " AND v.version = ?"
+		args = append(args, version)
+    }
+
+	var objectKey string
     var originalFilename string
-    err := db.DB.QueryRow("SELECT file_path, filename FROM files WHERE id = ?", fileID).Scan(&encryptedFilePath, &originalFilename)
+	var fileType string
+	var wrappedKey []byte
+	var keyID string
+	var createdAtStr string
+	err := db.DB.QueryRow(query, args...).
+		Scan(&objectKey, &originalFilename, &fileType, &wrappedKey, &keyID, &createdAtStr)
     if err == sql.ErrNoRows {
         log.Println("File not found:", err)
         http.Error(w, "File not found", http.StatusNotFound)
         return
     } else if err != nil {
-        log.Println("Error retrieving file path:", err)
+		log.Println("Error retrieving object key:", err)
         http.Error(w, "Internal server error", http.StatusInternalServerError)
         return
     }
+	createdAt, _ := time.Parse("2006-01-02 15:04:05", createdAtStr)
 
-    // Read the encrypted file content
-    encryptedData, err := os.ReadFile(encryptedFilePath)
-    if err != nil {
-        log.Println("Error reading encrypted file:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
-        return
-    }
-
-    // Decrypt the file content
-    encryptionKey := []byte("this_is_a_32_byte_key_for_aes_on") // Ensure you use the correct key
-    decryptedData, err := DecryptFile(encryptedData, encryptionKey)
+	// Open the blob for random access to its plaintext
+	decrypted, blob, err := openDecrypted(r.Context(), objectKey, wrappedKey, keyID)
     if err != nil {
         log.Println("Error decrypting file:", err)
         http.Error(w, "Internal server error", http.StatusInternalServerError)
         return
     }
+	defer blob.Close()
 
-    // Serve the decrypted content with the original filename
-    w.Header().Set("Content-Disposition", "attachment; filename="+originalFilename)
-    w.Header().Set("Content-Type", "application/octet-stream")
-    w.Header().Set("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
+	// The random nonce prefix of the stream changes with every encryption, so it is a strong validator
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", decrypted.Header().NoncePrefix))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": originalFilename}))
+	w.Header().Set("Content-Type", fileType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-    // Write the decrypted content to the response
-    _, err = w.Write(decryptedData)
-    if err != nil {
-        log.Println("Error serving decrypted file:", err)
-    }
+	var out http.ResponseWriter = w
+	if claim != nil {
+		out = &claimingWriter{ResponseWriter: w, r: r, size: decrypted.Size(), claim: claim}
+	}
+
+	// ServeContent handles HEAD, Range/If-Range (206/416, multipart/byteranges) and 304 responses
+	http.ServeContent(out, r, originalFilename, createdAt, io.NewSectionReader(decrypted, 0, decrypted.Size()))
 }
 
+// RemoveFile deletes a file with all of its versions from the database, credits the owner's usage
+// and releases the blobs;
+// a blob is only removed from the storage backend once its last reference goes away. It is the
+// single removal path for single deletes, recursive folder deletes and the cleanup worker.
+func RemoveFile(ctx context.Context, fileID int) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+    if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM files WHERE id = ? FOR UPDATE", fileID).Scan(&ownerID)
+	if err != nil {
+		return err
+	}
+
+	// One reference per version, even when several versions share a blob
+	rows, err := tx.QueryContext(ctx, `SELECT v.blob_id, b.size FROM file_versions v JOIN blobs b ON b.id = v.blob_id
+        WHERE v.file_id = ?`, fileID)
+	if err != nil {
+		return fmt.Errorf("error retrieving file versions: %w", err)
+	}
+	var blobIDs []int
+	var totalSize int64
+	for rows.Next() {
+		var blobID int
+		var size int64
+		if err := rows.Scan(&blobID, &size); err != nil {
+			rows.Close()
+			return fmt.Errorf("error retrieving file versions: %w", err)
+		}
+		blobIDs = append(blobIDs, blobID)
+		totalSize += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error retrieving file versions: %w", err)
+	}
+	for _, blobID := range blobIDs {
+		if err := releaseBlob(ctx, tx, blobID); err != nil {
+			return err
+		}
+	}
+	if err := releaseUsage(ctx, tx, ownerID, totalSize, 1); err != nil {
+		return err
+	}
+
+	// Everyone who could see the file must stop getting it from the search cache
+	invalidateSearchCache(ctx, fileID)
+
+	// Delete the metadata from the database; versions, permissions and shares go with it
+	_, err = tx.ExecContext(ctx, "DELETE FROM files WHERE id = ?", fileID)
+	if err != nil {
+		return fmt.Errorf("error deleting file metadata: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error deleting file metadata: %w", err)
+	}
+
+	for _, blobID := range blobIDs {
+		if err := deleteBlob(ctx, blobID); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
 
-// DeleteFile allows users to delete their files
+// DeleteFile allows owners and co-owners to delete files. Deleted files go to the owner's trash,
+// from where they can be restored until the background worker purges them.
 func DeleteFile(w http.ResponseWriter, r *http.Request, userID int) {
-    fileID := r.URL.Query().Get("file_id")
-
-    var filePath string
-    err := db.DB.QueryRow("SELECT file_path FROM files WHERE id = ? AND user_id = ?", fileID, userID).Scan(&filePath)
-    if err == sql.ErrNoRows {
-		log.Println(err)
-
-        http.Error(w, "File not found", http.StatusNotFound)
-        return
-    } else if err != nil {
-        log.Println("Error retrieving file path:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+	fileID, ok := fileIDParam(w, r)
+	if !ok || !authorize(w, r, userID, fileID, RoleCoOwner) {
         return
     }
 
-    // Delete the file from local storage
-    err = os.Remove(filePath)
+	moved, err := trashFile(r.Context(), fileID, userID, false)
     if err != nil {
 		log.Println(err)
-
         http.Error(w, "Error deleting file", http.StatusInternalServerError)
         return
     }
-
-    // Delete the metadata from the database
-    _, err = db.DB.Exec("DELETE FROM files WHERE id = ? AND user_id = ?", fileID, userID)
-    if err != nil {
-		log.Println(err)
-
-        http.Error(w, "Error deleting file metadata", http.StatusInternalServerError)
+	if !moved {
+		http.Error(w, "File not found", http.StatusNotFound)
         return
     }
 
     w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]string{"message": "File deleted successfully"})
+	json.NewEncoder(w).Encode(map[string]string{"message": "File moved to trash"})
 }
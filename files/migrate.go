@@ -0,0 +1,167 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"shareit/db"
+	"shareit/encryption"
+	"shareit/storage"
+)
+
+// LegacyKey is the AES-256 key the original upload handler had hard-coded. Every file uploaded
+// before envelope encryption is sealed with it, so it only protects data that still needs migrating.
+const LegacyKey = "this_is_a_32_byte_key_for_aes_on"
+
+// MigrateProgress is reported after every file of MigrateLegacyFiles
+type MigrateProgress struct {
+	Done   int
+	Failed int
+	Total  int
+}
+
+// errAlreadyMigrated is returned for a file another run migrated in the meantime
+var errAlreadyMigrated = errors.New("file already migrated")
+
+// MigrateLegacyFiles moves files uploaded by the original version into the blob store. Those are
+// rows of files with a file_path and no version: the file at file_path is one AES-GCM message
+// sealed with legacyKey. Each is re-encrypted under a new data key and recorded as version 1 of
+// its file, charged to its owner's usage. Files that fail are logged and left as they are, so the
+// migration can be run again once they are fixed. The legacy files are not deleted.
+func MigrateLegacyFiles(ctx context.Context, legacyKey []byte, progress func(MigrateProgress)) (MigrateProgress, error) {
+	var p MigrateProgress
+	rows, err := db.DB.QueryContext(ctx,
+		"SELECT id, user_id, filename, file_path FROM files WHERE current_version_id IS NULL AND file_path IS NOT NULL ORDER BY id")
+	if err != nil {
+		return p, fmt.Errorf("error querying legacy files: %w", err)
+	}
+	type legacyFile struct {
+		id       int
+		userID   sql.NullInt64
+		filename string
+		path     string
+	}
+	var legacy []legacyFile
+	for rows.Next() {
+		var f legacyFile
+		if err := rows.Scan(&f.id, &f.userID, &f.filename, &f.path); err != nil {
+			rows.Close()
+			return p, fmt.Errorf("error scanning legacy file: %w", err)
+		}
+		legacy = append(legacy, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return p, fmt.Errorf("error querying legacy files: %w", err)
+	}
+	p.Total = len(legacy)
+
+	for _, f := range legacy {
+		if !f.userID.Valid {
+			log.Printf("Skipping legacy file %d (%s): it has no owner", f.id, f.path)
+			p.Failed++
+		} else if err := migrateLegacyFile(ctx, legacyKey, f.id, int(f.userID.Int64), f.filename, f.path); err != nil && err != errAlreadyMigrated {
+			log.Printf("Error migrating legacy file %d (%s): %v", f.id, f.path, err)
+			p.Failed++
+		} else {
+			p.Done++
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	return p, nil
+}
+
+// migrateLegacyFile stores the legacy file at path as the first version of fileID
+func migrateLegacyFile(ctx context.Context, legacyKey []byte, fileID, userID int, filename, path string) error {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, err := openLegacy(sealed, legacyKey)
+	if err != nil {
+		return fmt.Errorf("error decrypting: %w", err)
+	}
+	// The legacy file_type was sniffed from the file name rather than the content; detect it again
+	contentType, _ := detectContentType(filename, bytes.NewReader(plain))
+
+	dataKey, wrappedKey, keyID, err := encryption.NewDataKey(ctx)
+	if err != nil {
+		return fmt.Errorf("error generating data key: %w", err)
+	}
+	objectKey, err := newObjectKey(userID)
+	if err != nil {
+		return fmt.Errorf("error generating object key: %w", err)
+	}
+	hashed := newHashingReader(bytes.NewReader(plain))
+	if err := encryptToStorage(ctx, objectKey, hashed, dataKey, encryption.KeyFingerprint(dataKey)); err != nil {
+		return fmt.Errorf("error storing encrypted file: %w", err)
+	}
+
+	b := blob{ContentHash: hashed.Sum(), ObjectKey: objectKey, WrappedKey: wrappedKey, KeyID: keyID, Size: hashed.n}
+	b, err = recordLegacyVersion(ctx, fileID, userID, b, contentType)
+	if err != nil || b.ObjectKey != objectKey {
+		if err := storage.Default.Delete(ctx, objectKey); err != nil {
+			log.Println("Error deleting redundant blob:", err)
+		}
+	}
+	return err
+}
+
+// recordLegacyVersion records b as version 1 of fileID. Usage is charged without checking the
+// quota: the file is stored already, it only moves.
+func recordLegacyVersion(ctx context.Context, fileID, userID int, b blob, contentType string) (blob, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return blob{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "SELECT id FROM files WHERE id = ? AND current_version_id IS NULL FOR UPDATE", fileID).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return blob{}, errAlreadyMigrated
+	}
+	if err != nil {
+		return blob{}, fmt.Errorf("error locking file: %w", err)
+	}
+
+	b, err = claimBlob(ctx, tx, userID, b)
+	if err != nil {
+		return blob{}, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET used_bytes = used_bytes + ?, used_files = used_files + 1 WHERE id = ?", b.Size, userID)
+	if err != nil {
+		return blob{}, fmt.Errorf("error updating storage usage: %w", err)
+	}
+	if _, err := addVersion(ctx, tx, fileID, b.ID, contentType, userID); err != nil {
+		return blob{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return blob{}, fmt.Errorf("error saving file version: %w", err)
+	}
+	return b, nil
+}
+
+// openLegacy decrypts the legacy format: a 12-byte nonce followed by the AES-GCM sealed file
+func openLegacy(sealed, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,30 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// The uploads directory still holds files written by the original upload handler
+func TestOpenLegacy(t *testing.T) {
+	sealed, err := os.ReadFile("../uploads/1_recat_proof.pdf.enc")
+	if err != nil {
+		t.Skip("no legacy upload to test with:", err)
+	}
+	plain, err := openLegacy(sealed, []byte(LegacyKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(plain, []byte("%PDF-")) {
+		t.Errorf("decrypted legacy upload starts with %q, want a PDF", plain[:8])
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := openLegacy(sealed, []byte(LegacyKey)); err == nil {
+		t.Error("opened a corrupted legacy upload")
+	}
+	if _, err := openLegacy(sealed[:5], []byte(LegacyKey)); err == nil {
+		t.Error("opened a truncated legacy upload")
+	}
+}
@@ -0,0 +1,302 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Role is a user's permission level on a file. Each level includes the ones below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleEditor
+	RoleCoOwner
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleViewer:  "viewer",
+	RoleEditor:  "editor",
+	RoleCoOwner: "co-owner",
+	RoleOwner:   "owner",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// parseRole accepts the roles that can be granted to other users
+func parseRole(name string) (Role, bool) {
+	for role, n := range roleNames {
+		if n == name && role != RoleOwner {
+			return role, true
+		}
+	}
+	return RoleNone, false
+}
+
+// fileRole returns the role userID holds on fileID, or RoleNone (with sql.ErrNoRows if the file does
+// not exist). Files in the trash only exist for fileRole when trashed is set, and vice versa.
+func fileRole(ctx context.Context, userID, fileID int, trashed bool) (Role, error) {
+	var ownerID int
+	var granted sql.NullString
+	err := db.DB.QueryRowContext(ctx, `SELECT f.user_id, p.role FROM files f
+		LEFT JOIN file_permissions p ON p.file_id = f.id AND p.user_id = ?
+		WHERE f.id = ? AND (f.deleted_at IS NOT NULL) = ?`, userID, fileID, trashed).Scan(&ownerID, &granted)
+	if err != nil {
+		return RoleNone, err
+	}
+	if ownerID == userID {
+		return RoleOwner, nil
+	}
+	role, _ := parseRole(granted.String)
+	return role, nil
+}
+
+// authorize checks that userID holds at least need on fileID and writes the error response if not.
+// Files the user cannot see at all, and files in the trash, are reported as not found so their
+// existence is not leaked.
+func authorize(w http.ResponseWriter, r *http.Request, userID, fileID int, need Role) bool {
+	return authorizeRole(w, r, userID, fileID, need, false)
+}
+
+// authorizeTrashed is authorize for files in the trash
+func authorizeTrashed(w http.ResponseWriter, r *http.Request, userID, fileID int, need Role) bool {
+	return authorizeRole(w, r, userID, fileID, need, true)
+}
+
+func authorizeRole(w http.ResponseWriter, r *http.Request, userID, fileID int, need Role, trashed bool) bool {
+	role, err := fileRole(r.Context(), userID, fileID, trashed)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error checking file permissions:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if role == RoleNone {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return false
+	}
+	if role < need {
+		http.Error(w, fmt.Sprintf("This action requires the %s role", need), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// fileIDParam parses the file_id query parameter, writing a 400 response if it is invalid
+func fileIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	fileID, err := strconv.Atoi(r.URL.Query().Get("file_id"))
+	if err != nil || fileID <= 0 {
+		http.Error(w, "file_id is required", http.StatusBadRequest)
+		return 0, false
+	}
+	return fileID, true
+}
+
+// invalidateSearchCache drops the cached SearchFile results of every user who can see fileID
+func invalidateSearchCache(ctx context.Context, fileID int) {
+	rows, err := db.DB.QueryContext(ctx, `SELECT user_id FROM files WHERE id = ?
+		UNION SELECT user_id FROM file_permissions WHERE file_id = ?`, fileID, fileID)
+	if err != nil {
+		log.Println("Error invalidating search cache:", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		if rows.Scan(&userID) == nil {
+			invalidateUserSearchCache(userID)
+		}
+	}
+}
+
+func invalidateUserSearchCache(userID int) {
+	if err := db.InvalidateCache(fmt.Sprintf("files:user:%d:*", userID)); err != nil {
+		log.Println("Error invalidating search cache:", err)
+	}
+}
+
+// Permission is an access grant on a file to another user
+type Permission struct {
+	FileID    int       `json:"file_id"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	GrantedBy int       `json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GrantPermission gives another registered user (by email) a role on a file. Requires co-owner.
+func GrantPermission(w http.ResponseWriter, r *http.Request, userID int) {
+	var req struct {
+		FileID int    `json:"file_id"`
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FileID == 0 || req.Email == "" {
+		http.Error(w, "file_id, email and role are required", http.StatusBadRequest)
+		return
+	}
+	role, ok := parseRole(req.Role)
+	if !ok {
+		http.Error(w, "role must be one of viewer, editor, co-owner", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, userID, req.FileID, RoleCoOwner) {
+		return
+	}
+
+	var granteeID, ownerID int
+	err := db.DB.QueryRow("SELECT id FROM users WHERE email = ?", strings.TrimSpace(req.Email)).Scan(&granteeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving user:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DB.QueryRow("SELECT user_id FROM files WHERE id = ?", req.FileID).Scan(&ownerID); err != nil {
+		log.Println("Error retrieving file owner:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if granteeID == ownerID {
+		http.Error(w, "The owner already has full access", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.DB.Exec(`INSERT INTO file_permissions (file_id, user_id, role, granted_by) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE role = VALUES(role), granted_by = VALUES(granted_by)`,
+		req.FileID, granteeID, role.String(), userID)
+	if err != nil {
+		log.Println("Error granting permission:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	invalidateUserSearchCache(granteeID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Access granted successfully"})
+}
+
+// RevokePermission removes a user's access to a file. Co-owners may remove anyone; any user may
+// remove their own access.
+func RevokePermission(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok {
+		return
+	}
+	targetID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	if targetID != userID && !authorize(w, r, userID, fileID, RoleCoOwner) {
+		return
+	}
+
+	result, err := db.DB.Exec("DELETE FROM file_permissions WHERE file_id = ? AND user_id = ?", fileID, targetID)
+	if err != nil {
+		log.Println("Error revoking permission:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Permission not found", http.StatusNotFound)
+		return
+	}
+	invalidateUserSearchCache(targetID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Access revoked successfully"})
+}
+
+// ListPermissions lists who a file is shared with. Requires co-owner.
+func ListPermissions(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok || !authorize(w, r, userID, fileID, RoleCoOwner) {
+		return
+	}
+
+	rows, err := db.DB.Query(`SELECT p.file_id, p.user_id, u.email, p.role, p.granted_by, p.created_at
+		FROM file_permissions p JOIN users u ON u.id = p.user_id WHERE p.file_id = ? ORDER BY p.created_at`, fileID)
+	if err != nil {
+		log.Println("Error retrieving permissions:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		var createdAtStr string
+		if err := rows.Scan(&p.FileID, &p.UserID, &p.Email, &p.Role, &p.GrantedBy, &createdAtStr); err != nil {
+			log.Println("Error scanning permission:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		p.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		permissions = append(permissions, p)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(permissions)
+}
+
+// sharedWithMeQuery selects the live files shared with a user and the role they were granted
+var sharedWithMeQuery = "SELECT " + fileColumns + ", p.role FROM " + fileTables + `
+	JOIN file_permissions p ON p.file_id = f.id AND p.user_id = ?
+	WHERE f.deleted_at IS NULL ORDER BY f.created_at DESC`
+
+// SharedWithMe lists the files other users have shared with the caller
+func SharedWithMe(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.DB.Query(sharedWithMeQuery, userID)
+	if err != nil {
+		log.Println("Error retrieving shared files:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		var role string
+		file, err := scanFile(rows, &role)
+		if err != nil {
+			log.Println("Error scanning file:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		file.Role = role
+		files = append(files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(files)
+}
+
+// DownloadFile streams a file the caller owns or has been given at least viewer access to.
+// ?version=N downloads an older version instead of the current one.
+func DownloadFile(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := versionParam(w, r)
+	if !ok || !authorize(w, r, userID, fileID, RoleViewer) {
+		return
+	}
+	serveFile(w, r, fileID, version, nil)
+}
@@ -0,0 +1,28 @@
+package files
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	columnAlias = regexp.MustCompile(`\b([a-z])\.[a-z_]+`)
+	tableAlias  = regexp.MustCompile(`(?:FROM|JOIN)\s+[a-z_]+\s+([a-z])\b`)
+)
+
+func TestSharedWithMeQuery(t *testing.T) {
+	joined := map[string]bool{}
+	for _, m := range tableAlias.FindAllStringSubmatch(sharedWithMeQuery, -1) {
+		joined[m[1]] = true
+	}
+	// Every alias the query reads from, in the select list and in the conditions, must be joined
+	for _, m := range columnAlias.FindAllStringSubmatch(sharedWithMeQuery, -1) {
+		if !joined[m[1]] {
+			t.Errorf("%s is read but table %s is not joined", m[0], m[1])
+		}
+	}
+	if n := strings.Count(sharedWithMeQuery, "?"); n != 1 {
+		t.Errorf("query takes %d parameters, SharedWithMe passes 1", n)
+	}
+}
@@ -0,0 +1,157 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"shareit/config"
+	"shareit/db"
+)
+
+var (
+	errQuotaExceeded = errors.New("storage quota exceeded")
+	errTooLarge      = errors.New("upload is larger than the storage quota")
+)
+
+// Default quotas for users without an override in users.quota_bytes / users.quota_files; 0 is unlimited
+var (
+	defaultQuotaBytes int64
+	defaultQuotaFiles int64
+)
+
+// InitQuotas takes the default per-user quotas from cfg
+func InitQuotas(cfg *config.Config) {
+	defaultQuotaBytes = cfg.QuotaDefaultBytes
+	defaultQuotaFiles = cfg.QuotaDefaultFiles
+}
+
+// Usage is a user's storage consumption against their quota. A quota of 0 is unlimited.
+// Every version of every file the user owns counts with its full size, whether or not its blob
+// is shared through deduplication.
+type Usage struct {
+	UsedBytes  int64 `json:"used_bytes"`
+	QuotaBytes int64 `json:"quota_bytes"`
+	UsedFiles  int64 `json:"used_files"`
+	QuotaFiles int64 `json:"quota_files"`
+}
+
+// remainingBytes is how much more the user may store, or -1 if unlimited
+func (u Usage) remainingBytes() int64 {
+	if u.QuotaBytes == 0 {
+		return -1
+	}
+	if u.UsedBytes >= u.QuotaBytes {
+		return 0
+	}
+	return u.QuotaBytes - u.UsedBytes
+}
+
+// userUsage loads the usage counters and effective quotas of userID
+func userUsage(ctx context.Context, userID int) (Usage, error) {
+	var u Usage
+	err := db.DB.QueryRowContext(ctx, `SELECT used_bytes, COALESCE(quota_bytes, ?), used_files, COALESCE(quota_files, ?)
+		FROM users WHERE id = ?`, defaultQuotaBytes, defaultQuotaFiles, userID).
+		Scan(&u.UsedBytes, &u.QuotaBytes, &u.UsedFiles, &u.QuotaFiles)
+	return u, err
+}
+
+// checkQuota tells early, before any data is accepted, whether size more bytes (and one more file
+// if newFile) would fit into ownerID's quota. chargeUsage makes the binding decision later.
+func checkQuota(ctx context.Context, ownerID int, size int64, newFile bool) error {
+	u, err := userUsage(ctx, ownerID)
+	if err != nil {
+		return err
+	}
+	if u.QuotaBytes > 0 && size > u.QuotaBytes {
+		return errTooLarge
+	}
+	if remaining := u.remainingBytes(); remaining >= 0 && size > remaining {
+		return errQuotaExceeded
+	}
+	if newFile && u.QuotaFiles > 0 && u.UsedFiles >= u.QuotaFiles {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chargeUsage adds bytes and files to ownerID's usage inside tx, failing with errQuotaExceeded if
+// that would go over a quota. The check and the update are a single statement, so concurrent
+// uploads cannot overshoot.
+func chargeUsage(ctx context.Context, tx *sql.Tx, ownerID int, bytes, files int64) error {
+	result, err := tx.ExecContext(ctx, `UPDATE users SET used_bytes = used_bytes + ?, used_files = used_files + ?
+		WHERE id = ?
+		AND (COALESCE(quota_bytes, ?) = 0 OR used_bytes + ? <= COALESCE(quota_bytes, ?))
+		AND (? = 0 OR COALESCE(quota_files, ?) = 0 OR used_files + ? <= COALESCE(quota_files, ?))`,
+		bytes, files, ownerID,
+		defaultQuotaBytes, bytes, defaultQuotaBytes,
+		files, defaultQuotaFiles, files, defaultQuotaFiles)
+	if err != nil {
+		return fmt.Errorf("error updating storage usage: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error updating storage usage: %w", err)
+	}
+	if affected == 0 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// releaseUsage subtracts bytes and files from ownerID's usage inside tx
+func releaseUsage(ctx context.Context, tx *sql.Tx, ownerID int, bytes, files int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE users SET used_bytes = GREATEST(used_bytes - ?, 0), used_files = GREATEST(used_files - ?, 0)
+		WHERE id = ?`, bytes, files, ownerID)
+	if err != nil {
+		return fmt.Errorf("error updating storage usage: %w", err)
+	}
+	return nil
+}
+
+// writeQuotaError answers a quota violation: 413 if the upload could never fit, 507 if the quota
+// is used up. It reports whether err was a quota error.
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errTooLarge):
+		http.Error(w, "File is larger than your storage quota", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+	default:
+		return false
+	}
+	return true
+}
+
+// quotaReader fails with errQuotaExceeded as soon as more than remaining bytes are read, so an
+// upload without a (truthful) Content-Length is cut off instead of being stored in full
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// GetUsage reports the caller's storage usage and quotas
+func GetUsage(w http.ResponseWriter, r *http.Request, userID int) {
+	u, err := userUsage(r.Context(), userID)
+	if err != nil {
+		log.Println("Error retrieving storage usage:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(u)
+}
@@ -0,0 +1,82 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+)
+
+func TestRemainingBytes(t *testing.T) {
+	if got := (Usage{UsedBytes: 500}).remainingBytes(); got != -1 {
+		t.Errorf("no quota: remainingBytes = %d, want -1", got)
+	}
+	if got := (Usage{UsedBytes: 300, QuotaBytes: 1000}).remainingBytes(); got != 700 {
+		t.Errorf("remainingBytes = %d, want 700", got)
+	}
+	// An admin may lower the quota below what is already stored
+	if got := (Usage{UsedBytes: 1500, QuotaBytes: 1000}).remainingBytes(); got != 0 {
+		t.Errorf("over quota: remainingBytes = %d, want 0", got)
+	}
+}
+
+func TestQuotaReader(t *testing.T) {
+	read := func(size int, remaining int64) error {
+		_, err := io.Copy(io.Discard, &quotaReader{r: bytes.NewReader(make([]byte, size)), remaining: remaining})
+		return err
+	}
+	if err := read(100, 100); err != nil {
+		t.Errorf("upload of exactly the remaining bytes: %v", err)
+	}
+	if err := read(0, 0); err != nil {
+		t.Errorf("empty upload with a full quota: %v", err)
+	}
+	if err := read(101, 100); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("upload one byte over: err = %v, want errQuotaExceeded", err)
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	request := func(partLength string, size int) (int64, int64) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("folder_id", "7")
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="a.bin"`)
+		if partLength != "" {
+			header.Set("Content-Length", partLength)
+		}
+		pw, _ := mw.CreatePart(header)
+		pw.Write(make([]byte, size))
+		mw.Close()
+
+		r := httptest.NewRequest("POST", "/files/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		part, _, err := nextFilePart(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uploadSize(r, part), r.ContentLength
+	}
+
+	if got, _ := request("1000", 1000); got != 1000 {
+		t.Errorf("part Content-Length: uploadSize = %d, want 1000", got)
+	}
+	// Like a browser: only the request has a length
+	got, total := request("", 100<<10)
+	if got != total-multipartOverhead || got > 100<<10 {
+		t.Errorf("request length %d: uploadSize = %d, want %d", total, got, total-multipartOverhead)
+	}
+	if got, _ := request("", 100); got != 0 {
+		t.Errorf("small upload: uploadSize = %d, want 0", got)
+	}
+
+	r := httptest.NewRequest("POST", "/files/upload", nil)
+	r.ContentLength = -1
+	if got := uploadSize(r, &multipart.Part{Header: textproto.MIMEHeader{}}); got != -1 {
+		t.Errorf("chunked request: uploadSize = %d, want -1", got)
+	}
+}
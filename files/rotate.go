@@ -0,0 +1,123 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"shareit/db"
+	"shareit/encryption"
+	"time"
+)
+
+// RewrapProgress is reported after every batch of RewrapDataKeys
+type RewrapProgress struct {
+	Done   int
+	Failed int
+	Total  int
+	KeyID  string
+}
+
+// RewrapDataKeys re-wraps every data key in the blobs table that is not yet wrapped under the
+// current master key version. The encrypted objects are never touched. Each batch is committed on its own, so
+// an interrupted run can simply be started again and continues with the remaining rows.
+//
+// Servers keep wrapping new data keys under the previous master key until they notice the rotated
+// keyring, so the table is scanned again until a pass finds only rows that failed, and for at least
+// encryption.KeyringReloadInterval.
+func RewrapDataKeys(ctx context.Context, batchSize int, progress func(RewrapProgress)) (RewrapProgress, error) {
+	current, err := encryption.Keys.CurrentKeyID(ctx)
+	if err != nil {
+		return RewrapProgress{}, fmt.Errorf("error getting current master key: %w", err)
+	}
+	p := RewrapProgress{KeyID: current}
+	settled := time.Now().Add(encryption.KeyringReloadInterval)
+
+	for {
+		var remaining int
+		err = db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM blobs WHERE key_id <> ?", current).Scan(&remaining)
+		if err != nil {
+			return p, fmt.Errorf("error counting data keys to re-wrap: %w", err)
+		}
+		if remaining == p.Failed && time.Now().After(settled) {
+			return p, nil
+		}
+		if remaining == p.Failed {
+			// Nothing new yet; wait for servers that may still wrap under the previous key
+			select {
+			case <-ctx.Done():
+				return p, ctx.Err()
+			case <-time.After(time.Until(settled)):
+			}
+			continue
+		}
+
+		p.Total = p.Done + remaining
+		p.Failed = 0
+		if err := rewrapPass(ctx, current, batchSize, &p, progress); err != nil {
+			return p, err
+		}
+	}
+}
+
+// rewrapPass re-wraps the data keys not wrapped under current once, in batches of batchSize
+func rewrapPass(ctx context.Context, current string, batchSize int, p *RewrapProgress, progress func(RewrapProgress)) error {
+	lastID := 0
+	for {
+		rows, err := db.DB.QueryContext(ctx,
+			"SELECT id, wrapped_key, key_id FROM blobs WHERE key_id <> ? AND id > ? ORDER BY id LIMIT ?",
+			current, lastID, batchSize)
+		if err != nil {
+			return fmt.Errorf("error querying data keys: %w", err)
+		}
+
+		type row struct {
+			id         int
+			wrappedKey []byte
+			keyID      string
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.wrappedKey, &r.keyID); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning data key: %w", err)
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error querying data keys: %w", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		tx, err := db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range batch {
+			lastID = r.id
+			wrapped, keyID, err := encryption.RewrapKey(ctx, r.keyID, r.wrappedKey)
+			if err != nil {
+				// Leave the row on its old version; a later run will retry it
+				p.Failed++
+				continue
+			}
+			// Only replace the key if nobody re-wrapped or replaced the row in the meantime
+			_, err = tx.ExecContext(ctx, "UPDATE blobs SET wrapped_key = ?, key_id = ? WHERE id = ? AND key_id = ?",
+				wrapped, keyID, r.id, r.keyID)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error updating data key of blob %d: %w", r.id, err)
+			}
+			p.Done++
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing re-wrapped data keys: %w", err)
+		}
+
+		if progress != nil {
+			progress(*p)
+		}
+	}
+}
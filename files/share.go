@@ -0,0 +1,416 @@
+package files
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"shareit/config"
+	"shareit/db"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// publicBaseURL prefixes the share links handed out to users (PUBLIC_BASE_URL)
+var publicBaseURL string
+
+// InitSharing takes the base URL of share links from cfg
+func InitSharing(cfg *config.Config) {
+	publicBaseURL = cfg.PublicBaseURL
+}
+
+// Share is a public link to a file. Only a SHA-256 hash of the token is stored, so the link
+// itself is shown once, when the share is created.
+type Share struct {
+	ID            int        `json:"id"`
+	FileID        int        `json:"file_id"`
+	Filename      string     `json:"filename"`
+	CreatedBy     int        `json:"created_by"`
+	URL           string     `json:"url,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	MaxDownloads  *int       `json:"max_downloads"`
+	DownloadCount int        `json:"download_count"`
+	HasPassword   bool       `json:"has_password"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// shareRequest is the payload accepted by ShareFile
+type shareRequest struct {
+	FileID       int    `json:"file_id"`
+	ExpiresIn    string `json:"expires_in"` // Go duration, e.g. "72h"
+	MaxDownloads *int   `json:"max_downloads"`
+	Password     string `json:"password"`
+}
+
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ShareFile creates an unguessable public link to a file the user owns or co-owns, optionally
+// limited by expiry, number of downloads and a password
+func ShareFile(w http.ResponseWriter, r *http.Request, userID int) {
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FileID == 0 {
+		http.Error(w, "file_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Public links bypass per-user permissions, so only owners and co-owners may create them
+	if !authorize(w, r, userID, req.FileID, RoleCoOwner) {
+		return
+	}
+	var filename string
+	err := db.DB.QueryRow("SELECT filename FROM files WHERE id = ?", req.FileID).Scan(&filename)
+	if err != nil {
+		log.Println("Error retrieving file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expires_in must be a positive duration such as \"24h\"", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(d).Truncate(time.Second)
+		expiresAt = &t
+	}
+	if req.MaxDownloads != nil && *req.MaxDownloads <= 0 {
+		http.Error(w, "max_downloads must be positive", http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash []byte
+	if req.Password != "" {
+		passwordHash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Error hashing password", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 256 bits of randomness make share links impossible to enumerate
+	raw := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		log.Println("Error generating share token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	result, err := db.DB.Exec("INSERT INTO shares (token_hash, file_id, created_by, expires_at, max_downloads, password_hash) VALUES (?, ?, ?, ?, ?, ?)",
+		hashShareToken(token), req.FileID, userID, expiresAt, req.MaxDownloads, passwordHash)
+	if err != nil {
+		log.Println("Error creating share:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	shareID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Share{
+		ID:           int(shareID),
+		FileID:       req.FileID,
+		Filename:     filename,
+		URL:          publicBaseURL + "/files/access/" + token,
+		ExpiresAt:    expiresAt,
+		MaxDownloads: req.MaxDownloads,
+		HasPassword:  passwordHash != nil,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// ListShares returns the shares the user created and every share on the files the user owns or
+// co-owns, optionally filtered by file_id
+func ListShares(w http.ResponseWriter, r *http.Request, userID int) {
+	query := `SELECT s.id, s.file_id, f.filename, s.created_by, s.expires_at, s.max_downloads, s.download_count,
+		s.password_hash IS NOT NULL, s.revoked_at, s.created_at
+		FROM shares s JOIN files f ON f.id = s.file_id
+		WHERE (s.created_by = ? OR f.user_id = ? OR EXISTS (SELECT 1 FROM file_permissions p
+			WHERE p.file_id = s.file_id AND p.user_id = ? AND p.role = ?))`
+	args := []interface{}{userID, userID, userID, RoleCoOwner.String()}
+	if r.URL.Query().Get("file_id") != "" {
+		fileID, ok := fileIDParam(w, r)
+		if !ok {
+			return
+		}
+		query += " AND s.file_id = ?"
+		args = append(args, fileID)
+	}
+	query += " ORDER BY s.created_at DESC"
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		log.Println("Error retrieving shares:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		var expiresAt, revokedAt sql.NullString
+		var maxDownloads sql.NullInt64
+		var createdAtStr string
+		if err := rows.Scan(&share.ID, &share.FileID, &share.Filename, &share.CreatedBy, &expiresAt, &maxDownloads, &share.DownloadCount,
+			&share.HasPassword, &revokedAt, &createdAtStr); err != nil {
+			log.Println("Error scanning share:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		share.ExpiresAt = parseNullTime(expiresAt)
+		share.RevokedAt = parseNullTime(revokedAt)
+		if maxDownloads.Valid {
+			n := int(maxDownloads.Int64)
+			share.MaxDownloads = &n
+		}
+		share.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		shares = append(shares, share)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(shares)
+}
+
+// RevokeShare disables a share immediately. The user who created it, the file owner and the file's
+// co-owners may revoke it.
+func RevokeShare(w http.ResponseWriter, r *http.Request, userID int) {
+	shareID := r.URL.Query().Get("share_id")
+
+	var fileID, createdBy int
+	err := db.DB.QueryRow("SELECT file_id, created_by FROM shares WHERE id = ? AND revoked_at IS NULL", shareID).
+		Scan(&fileID, &createdBy)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving share:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if createdBy != userID {
+		role, err := fileRole(r.Context(), userID, fileID, false)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error checking file permissions:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if role < RoleCoOwner {
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	result, err := db.DB.Exec("UPDATE shares SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), shareID)
+	if err != nil {
+		log.Println("Error revoking share:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Share revoked successfully"})
+}
+
+// ServeFile streams the file behind a share token after checking revocation, expiry, the password
+// and the download limit. The password may be sent as HTTP Basic auth (so browsers prompt for
+// it) or in the X-Share-Password header.
+func ServeFile(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var shareID, fileID, downloadCount, createdBy, ownerID int
+	var expiresAt, revokedAt, creatorRole sql.NullString
+	var maxDownloads sql.NullInt64
+	var passwordHash []byte
+	// Links to files in the trash behave as if the file did not exist
+	err := db.DB.QueryRow(`SELECT s.id, s.file_id, s.expires_at, s.max_downloads, s.download_count, s.password_hash, s.revoked_at,
+		s.created_by, f.user_id, p.role
+		FROM shares s JOIN files f ON f.id = s.file_id
+		LEFT JOIN file_permissions p ON p.file_id = s.file_id AND p.user_id = s.created_by
+		WHERE s.token_hash = ? AND f.deleted_at IS NULL`, hashShareToken(token)).
+		Scan(&shareID, &fileID, &expiresAt, &maxDownloads, &downloadCount, &passwordHash, &revokedAt, &createdBy, &ownerID, &creatorRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving share:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// A link only lives as long as its creator may still create it, so a co-owner who loses access
+	// takes their links along
+	if revokedAt.Valid || !canShare(createdBy, ownerID, creatorRole.String) {
+		http.Error(w, "This link has been revoked", http.StatusGone)
+		return
+	}
+	if t := parseNullTime(expiresAt); t != nil && time.Now().After(*t) {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	if maxDownloads.Valid && int64(downloadCount) >= maxDownloads.Int64 {
+		http.Error(w, "This link has reached its download limit", http.StatusGone)
+		return
+	}
+
+	if passwordHash != nil {
+		password := r.Header.Get("X-Share-Password")
+		if _, basic, ok := r.BasicAuth(); ok {
+			password = basic
+		}
+		if password == "" || bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="shared file"`)
+			http.Error(w, "Password required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Claim a download atomically so concurrent requests cannot exceed the limit; only once the
+	// response is known to carry the file, so 304s, 416s and failures are not counted
+	serveFile(w, r, fileID, 0, func() error {
+		result, err := db.DB.Exec(`UPDATE shares SET download_count = download_count + 1
+			WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)`, shareID)
+		if err != nil {
+			return fmt.Errorf("error counting download: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errDownloadLimit
+		}
+		return nil
+	})
+}
+
+var errDownloadLimit = errors.New("download limit reached")
+
+// canShare reports whether userID may create public links to a file owned by ownerID on which
+// they were granted role ("" if none)
+func canShare(userID, ownerID int, role string) bool {
+	if userID == ownerID {
+		return true
+	}
+	r, ok := parseRole(role)
+	return ok && r >= RoleCoOwner
+}
+
+// countsAsDownload reports whether a response with status to r (size bytes of content) delivers
+// the start of the file. Every complete copy needs byte 0, so counting only those responses bounds
+// the number of copies by max_downloads, while players and download managers can still resume and
+// seek. HEAD requests never count.
+func countsAsDownload(r *http.Request, status int, size int64) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	switch status {
+	case http.StatusOK:
+		// No Range, a failed If-Range or a range ServeContent chose to ignore: the whole file
+		return true
+	case http.StatusPartialContent:
+		for _, start := range rangeStarts(r.Header.Get("Range"), size) {
+			if start == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rangeStarts returns the first offset of every satisfiable range in a Range header, parsed like
+// http.ServeContent does: "start-end", "start-" and the suffix form "-length", which covers the
+// whole file when length reaches its size
+func rangeStarts(header string, size int64) []int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil
+	}
+	var starts []int64
+	for _, part := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			continue
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				continue
+			}
+			starts = append(starts, size-min(n, size))
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 || start >= size {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// claimingWriter claims a download when the response status shows the file is being delivered. On
+// failure it answers with the error instead and drops the body ServeContent goes on writing.
+type claimingWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	size     int64
+	claim    func() error
+	rejected bool
+}
+
+func (cw *claimingWriter) WriteHeader(status int) {
+	if countsAsDownload(cw.r, status, cw.size) {
+		if err := cw.claim(); err != nil {
+			cw.rejected = true
+			h := cw.Header()
+			for _, name := range []string{"Content-Range", "Content-Disposition", "ETag", "Last-Modified", "Accept-Ranges"} {
+				h.Del(name)
+			}
+			if errors.Is(err, errDownloadLimit) {
+				http.Error(cw.ResponseWriter, "This link has reached its download limit", http.StatusGone)
+			} else {
+				log.Println(err)
+				http.Error(cw.ResponseWriter, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *claimingWriter) Write(p []byte) (int, error) {
+	if cw.rejected {
+		return len(p), nil
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// parseNullTime parses a nullable DATETIME column
+func parseNullTime(value sql.NullString) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", value.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
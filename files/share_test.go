@@ -0,0 +1,120 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeStarts(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []int64
+	}{
+		{"no header", "", 100, nil},
+		{"other unit", "items=0-10", 100, nil},
+		{"start-end", "bytes=0-9", 100, []int64{0}},
+		{"open ended", "bytes=50-", 100, []int64{50}},
+		{"suffix", "bytes=-10", 100, []int64{90}},
+		{"suffix covering the file", "bytes=-100", 100, []int64{0}},
+		{"suffix longer than the file", "bytes=-500", 100, []int64{0}},
+		{"several ranges", "bytes=10-19, 0-4", 100, []int64{10, 0}},
+		{"spaces", "bytes= 5 - 9 ", 100, []int64{5}},
+		{"start past the end", "bytes=100-", 100, nil},
+		{"unsatisfiable and satisfiable", "bytes=200-300,0-1", 100, []int64{0}},
+		{"malformed", "bytes=abc,5", 100, nil},
+		{"negative suffix", "bytes=--5", 100, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rangeStarts(tt.header, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("rangeStarts(%q, %d) = %v, want %v", tt.header, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClaimingWriter serves a file through http.ServeContent like serveFile does and checks which
+// responses count as a download
+func TestClaimingWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		claimErr   error
+		wantStatus int
+		wantClaims int
+		wantBody   bool
+	}{
+		{"whole file", http.MethodGet, nil, nil, http.StatusOK, 1, true},
+		{"head", http.MethodHead, nil, nil, http.StatusOK, 0, false},
+		{"first bytes", http.MethodGet, map[string]string{"Range": "bytes=0-99"}, nil, http.StatusPartialContent, 1, true},
+		{"later bytes", http.MethodGet, map[string]string{"Range": "bytes=100-"}, nil, http.StatusPartialContent, 0, true},
+		{"suffix of the whole file", http.MethodGet, map[string]string{"Range": "bytes=-5000"}, nil, http.StatusPartialContent, 1, true},
+		{"short suffix", http.MethodGet, map[string]string{"Range": "bytes=-10"}, nil, http.StatusPartialContent, 0, true},
+		{"multipart including the start", http.MethodGet, map[string]string{"Range": "bytes=500-509,0-9"}, nil, http.StatusPartialContent, 1, true},
+		{"unsatisfiable", http.MethodGet, map[string]string{"Range": "bytes=5000-"}, nil, http.StatusRequestedRangeNotSatisfiable, 0, false},
+		{"not modified", http.MethodGet, map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, nil, http.StatusNotModified, 0, false},
+		{"failed If-Range serves the whole file", http.MethodGet, map[string]string{"Range": "bytes=100-", "If-Range": modified.Add(-time.Hour).Format(http.TimeFormat)}, nil, http.StatusOK, 1, true},
+		{"limit reached", http.MethodGet, nil, errDownloadLimit, http.StatusGone, 1, false},
+		{"claim failed", http.MethodGet, map[string]string{"Range": "bytes=0-9"}, errors.New("database down"), http.StatusInternalServerError, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/files/access/token", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			claims := 0
+			cw := &claimingWriter{ResponseWriter: rec, r: r, size: int64(len(content)), claim: func() error {
+				claims++
+				return tt.claimErr
+			}}
+			http.ServeContent(cw, r, "file.txt", modified, bytes.NewReader(content))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if claims != tt.wantClaims {
+				t.Errorf("claims = %d, want %d", claims, tt.wantClaims)
+			}
+			body := rec.Body.String()
+			if gotContent := strings.Contains(body, "0123456789") || strings.Contains(body, "9012345678"); gotContent != tt.wantBody {
+				t.Errorf("body has file content = %v, want %v (%q...)", gotContent, tt.wantBody, body[:min(len(body), 40)])
+			}
+			if tt.claimErr != nil && rec.Header().Get("Content-Range") != "" {
+				t.Error("rejected response kept its Content-Range")
+			}
+		})
+	}
+}
+
+func TestCanShare(t *testing.T) {
+	tests := []struct {
+		name    string
+		creator int
+		role    string
+		want    bool
+	}{
+		{"owner", 1, "", true},
+		{"co-owner", 2, "co-owner", true},
+		{"demoted to editor", 2, "editor", false},
+		{"permission revoked", 2, "", false},
+	}
+	for _, tt := range tests {
+		if got := canShare(tt.creator, 1, tt.role); got != tt.want {
+			t.Errorf("%s: canShare = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
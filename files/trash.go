@@ -0,0 +1,166 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/db"
+	"time"
+)
+
+// TrashedFile is a file in the trash
+type TrashedFile struct {
+	File
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy int       `json:"deleted_by"`
+}
+
+// trashFile moves a file to the trash. With detach the file is also taken out of its folder, for
+// folders that are being deleted. It reports whether the file was moved, false if it was already
+// in the trash or does not exist.
+func trashFile(ctx context.Context, fileID, userID int, detach bool) (bool, error) {
+	result, err := db.DB.ExecContext(ctx, "UPDATE files SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL",
+		time.Now(), userID, fileID)
+	if err != nil {
+		return false, fmt.Errorf("error moving file to trash: %w", err)
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error moving file to trash: %w", err)
+	}
+	if detach {
+		if _, err := db.DB.ExecContext(ctx, "UPDATE files SET folder_id = NULL WHERE id = ?", fileID); err != nil {
+			return false, fmt.Errorf("error moving file to trash: %w", err)
+		}
+	}
+
+	// Everyone who could see the file must stop getting it from the search cache
+	invalidateSearchCache(ctx, fileID)
+	return moved > 0, nil
+}
+
+// ListTrash lists the trashed files the caller owns or co-owns, most recently deleted first
+func ListTrash(w http.ResponseWriter, r *http.Request, userID int) {
+	rows, err := db.DB.Query(`SELECT `+fileColumns+`, COALESCE(p.role, 'owner'), f.deleted_at, f.deleted_by
+		FROM `+fileTables+` LEFT JOIN file_permissions p ON p.file_id = f.id AND p.user_id = ?
+		WHERE (f.user_id = ? OR p.role = 'co-owner') AND f.deleted_at IS NOT NULL
+		ORDER BY f.deleted_at DESC`, userID, userID)
+	if err != nil {
+		log.Println("Error retrieving trash:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	trashed := []TrashedFile{}
+	for rows.Next() {
+		var t TrashedFile
+		var role, deletedAtStr string
+		var deletedBy sql.NullInt64
+		t.File, err = scanFile(rows, &role, &deletedAtStr, &deletedBy)
+		if err != nil {
+			log.Println("Error scanning file:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		t.Role = role
+		t.DeletedAt, _ = time.Parse("2006-01-02 15:04:05", deletedAtStr)
+		t.DeletedBy = int(deletedBy.Int64)
+		trashed = append(trashed, t)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(trashed)
+}
+
+// RestoreFile takes a file out of the trash (owner or co-owner). It fails with 409 if a live file
+// of the same name has since taken its place, in its folder or, for files of deleted folders, in the
+// root; the user can rename or move that file and retry.
+func RestoreFile(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok || !authorizeTrashed(w, r, userID, fileID, RoleCoOwner) {
+		return
+	}
+
+	var ownerID int
+	var folderID *int
+	var filename string
+	if err := db.DB.QueryRow("SELECT user_id, folder_id, filename FROM files WHERE id = ?", fileID).Scan(&ownerID, &folderID, &filename); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+	if err := checkFileNameFree(r.Context(), ownerID, folderID, filename, fileID); err != nil {
+		writeFolderError(w, err)
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE files SET deleted_at = NULL, deleted_by = NULL WHERE id = ? AND deleted_at IS NOT NULL", fileID)
+	if err != nil {
+		log.Println("Error restoring file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	invalidateSearchCache(r.Context(), fileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File restored successfully"})
+}
+
+// PurgeFile permanently deletes a file from the trash (owner or co-owner)
+func PurgeFile(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok || !authorizeTrashed(w, r, userID, fileID, RoleCoOwner) {
+		return
+	}
+
+	err := RemoveFile(r.Context(), fileID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error deleting file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File deleted permanently"})
+}
+
+// PurgeTrash permanently deletes files that have been in the trash for longer than retention
+func PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, "SELECT id FROM files WHERE deleted_at < ?", time.Now().Add(-retention))
+	if err != nil {
+		return 0, fmt.Errorf("error querying trash: %w", err)
+	}
+	var fileIDs []int
+	for rows.Next() {
+		var fileID int
+		if err := rows.Scan(&fileID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning file id: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error querying trash: %w", err)
+	}
+
+	purged := 0
+	for _, fileID := range fileIDs {
+		if err := RemoveFile(ctx, fileID); err != nil && err != sql.ErrNoRows {
+			log.Printf("error purging file %d: %v", fileID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
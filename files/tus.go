@@ -0,0 +1,509 @@
+package files
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"shareit/config"
+	"shareit/encryption"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads implement tus 1.0.0 (https://tus.io/protocols/resumable-upload) with the
+// creation, termination and expiration extensions. Partial uploads are staged on local disk,
+// encrypted with AES-CTR under a per-upload key wrapped by the master key, so they survive
+// restarts without ever sitting in plaintext. On completion they go through storeFile like
+// any multipart upload.
+const tusVersion = "1.0.0"
+
+var (
+	tusDir     = "./tus_uploads"
+	tusBaseURL = "/files/tus/"
+	tusExpiry  = 24 * time.Hour
+	tusMaxSize int64
+	tusLocks   sync.Map // upload id -> *sync.Mutex
+)
+
+// tusUpload is the state of a resumable upload, persisted as <id>.info next to the <id>.bin data
+type tusUpload struct {
+	ID          string    `json:"id"`
+	UserID      int       `json:"user_id"`
+	Length      int64     `json:"length"`
+	Filename    string    `json:"filename"`
+	FolderID    *int      `json:"folder_id,omitempty"`
+	TargetID    int       `json:"target_id,omitempty"`
+	RawMetadata string    `json:"raw_metadata"`
+	WrappedKey  []byte    `json:"wrapped_key"`
+	KeyID       string    `json:"key_id"`
+	IV          []byte    `json:"iv"`
+	FileID      int64     `json:"file_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// InitResumableUploads takes the staging configuration (TUS_UPLOAD_DIR, TUS_UPLOAD_EXPIRY, TUS_MAX_SIZE) from cfg.
+// The API server stages uploads in the directory and the worker purges expired ones from it, so both
+// must resolve it to the same place: a relative TUS_UPLOAD_DIR depends on the working directory.
+// Upload URLs are absolute under PUBLIC_BASE_URL, since clients behind a reverse proxy would resolve
+// a relative Location against the wrong origin.
+func InitResumableUploads(cfg *config.Config) {
+	tusBaseURL = cfg.PublicBaseURL + "/files/tus/"
+	if cfg.TusUploadDir != "" {
+		tusDir = cfg.TusUploadDir
+	}
+	dir, err := filepath.Abs(tusDir)
+	if err != nil {
+		log.Fatal("Could not resolve TUS_UPLOAD_DIR: ", err)
+	}
+	tusDir = dir
+	tusExpiry = cfg.TusUploadExpiry
+	tusMaxSize = cfg.TusMaxSize
+	if err := os.MkdirAll(tusDir, 0o700); err != nil {
+		log.Fatal("Could not create resumable upload directory: ", err)
+	}
+	log.Println("Staging resumable uploads in", tusDir)
+}
+
+func tusPath(id, ext string) string {
+	return filepath.Join(tusDir, id+ext)
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	// Upload ids are hex strings we generated; anything else cannot name a staged upload
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, fs.ErrNotExist
+	}
+	data, err := os.ReadFile(tusPath(id, ".info"))
+	if err != nil {
+		return nil, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (u *tusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := tusPath(u.ID, ".info.tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tusPath(u.ID, ".info"))
+}
+
+func (u *tusUpload) remove() {
+	os.Remove(tusPath(u.ID, ".bin"))
+	os.Remove(tusPath(u.ID, ".info"))
+	tusLocks.Delete(u.ID)
+}
+
+// offset returns how many bytes have been received so far
+func (u *tusUpload) offset() (int64, error) {
+	if u.FileID != 0 {
+		return u.Length, nil
+	}
+	fi, err := os.Stat(tusPath(u.ID, ".bin"))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// stream returns the AES-CTR keystream of the staged data positioned at offset
+func (u *tusUpload) stream(ctx context.Context, offset int64) (cipher.Stream, error) {
+	key, err := encryption.Keys.UnwrapKey(ctx, u.KeyID, u.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Advance the 128-bit big-endian counter to the block containing offset
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, u.IV)
+	blocks := uint64(offset / aes.BlockSize)
+	low := binary.BigEndian.Uint64(counter[8:])
+	binary.BigEndian.PutUint64(counter[8:], low+blocks)
+	if low+blocks < low {
+		binary.BigEndian.PutUint64(counter[:8], binary.BigEndian.Uint64(counter[:8])+1)
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header ("key base64value,key base64value")
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata pair %q", pair)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func tusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// checkTusResumable rejects requests from clients speaking another protocol version
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	tusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// lookupTusUpload loads the upload named in the URL, hiding other users' uploads and expiring stale ones
+func lookupTusUpload(w http.ResponseWriter, r *http.Request, userID int) *tusUpload {
+	upload, err := loadTusUpload(mux.Vars(r)["upload_id"])
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && upload.UserID != userID) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		log.Println("Error loading resumable upload:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		upload.remove()
+		http.Error(w, "Upload expired", http.StatusGone)
+		return nil
+	}
+	return upload
+}
+
+// TusOptions advertises the supported tus version and extensions
+func TusOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	if tusMaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate starts a new resumable upload (creation extension)
+func TusCreate(w http.ResponseWriter, r *http.Request, userID int) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if tusMaxSize > 0 && length > tusMaxSize {
+		http.Error(w, "Upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	filename = filepath.Base(filename)
+	if filename == "." || filename == "/" {
+		http.Error(w, "Upload-Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+
+	// file_id uploads a new version of an existing file, otherwise folder_id places a new one
+	var targetID int
+	var folderID *int
+	if metadata["file_id"] != "" {
+		targetID, err = strconv.Atoi(metadata["file_id"])
+		if err != nil {
+			http.Error(w, "Invalid file_id", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, userID, targetID, RoleEditor) {
+			return
+		}
+	} else {
+		folderID, err = parseFolderID(r.Context(), metadata["folder_id"], userID)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
+	}
+
+	// Refuse uploads that cannot fit the owner's quota before any data is sent
+	err = precheckUpload(r.Context(), upload{UserID: userID, FolderID: folderID, FileID: targetID, Filename: filename}, length)
+	if writeQuotaError(w, err) {
+		return
+	} else if err != nil {
+		log.Println("Error checking storage quota:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The staging key is only ever needed in its wrapped form until a chunk arrives
+	_, wrappedKey, keyID, err := encryption.NewDataKey(r.Context())
+	if err != nil {
+		log.Println("Error generating staging key:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		log.Println("Error generating upload id:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		log.Println("Error generating staging IV:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	upload := &tusUpload{
+		ID:          hex.EncodeToString(id),
+		UserID:      userID,
+		Length:      length,
+		Filename:    filename,
+		FolderID:    folderID,
+		TargetID:    targetID,
+		RawMetadata: r.Header.Get("Upload-Metadata"),
+		WrappedKey:  wrappedKey,
+		KeyID:       keyID,
+		IV:          iv,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(tusExpiry),
+	}
+	if err := os.WriteFile(tusPath(upload.ID, ".bin"), nil, 0o600); err != nil {
+		log.Println("Error creating resumable upload:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := upload.save(); err != nil {
+		upload.remove()
+		log.Println("Error creating resumable upload:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", tusBaseURL+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead reports how much of an upload the server has received
+func TusHead(w http.ResponseWriter, r *http.Request, userID int) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload := lookupTusUpload(w, r, userID)
+	if upload == nil {
+		return
+	}
+
+	offset, err := upload.offset()
+	if err != nil {
+		log.Println("Error reading resumable upload offset:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.RawMetadata != "" {
+		w.Header().Set("Upload-Metadata", upload.RawMetadata)
+	}
+	if upload.FileID != 0 {
+		w.Header().Set("X-File-Id", strconv.FormatInt(upload.FileID, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch appends a chunk at the current offset and stores the file once every byte has arrived
+func TusPatch(w http.ResponseWriter, r *http.Request, userID int) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	upload := lookupTusUpload(w, r, userID)
+	if upload == nil {
+		return
+	}
+
+	// One PATCH at a time per upload
+	lock, _ := tusLocks.LoadOrStore(upload.ID, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		http.Error(w, "Upload is locked by another request", http.StatusLocked)
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	offset, err := upload.offset()
+	if err != nil {
+		log.Println("Error reading resumable upload offset:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+	if upload.FileID != 0 {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("X-File-Id", strconv.FormatInt(upload.FileID, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if offset < upload.Length {
+		offset, err = upload.appendChunk(r.Context(), r.Body, offset)
+		if err != nil {
+			// Whatever reached the disk is kept; the client resumes from the offset reported by HEAD
+			log.Println("Error appending to resumable upload:", err)
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Every byte has arrived: move the upload into permanent storage. If this fails the staged
+	// data is kept and the client can retry with an empty PATCH at the final offset.
+	fileID, err := upload.finish(context.WithoutCancel(r.Context()))
+	if writeQuotaError(w, err) {
+		return
+	} else if err != nil {
+		log.Println("Error storing completed resumable upload:", err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-File-Id", strconv.FormatInt(fileID, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendChunk encrypts body onto the staged data, never writing past the declared length
+func (u *tusUpload) appendChunk(ctx context.Context, body io.Reader, offset int64) (int64, error) {
+	stream, err := u.stream(ctx, offset)
+	if err != nil {
+		return offset, err
+	}
+	f, err := os.OpenFile(tusPath(u.ID, ".bin"), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return offset, err
+	}
+	n, copyErr := io.Copy(cipher.StreamWriter{S: stream, W: f}, io.LimitReader(body, u.Length-offset))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return offset + n, copyErr
+}
+
+// finish decrypts the staged data into storeFile and keeps a completed marker until expiry
+func (u *tusUpload) finish(ctx context.Context) (int64, error) {
+	stream, err := u.stream(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(tusPath(u.ID, ".bin"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	target := upload{UserID: u.UserID, FolderID: u.FolderID, FileID: u.TargetID, Filename: u.Filename}
+	stored, err := storeFile(ctx, target, cipher.StreamReader{S: stream, R: f})
+	if err != nil {
+		return 0, err
+	}
+
+	fileID := int64(stored.FileID)
+	u.FileID = fileID
+	if err := u.save(); err != nil {
+		log.Println("Error marking resumable upload complete:", err)
+	}
+	os.Remove(tusPath(u.ID, ".bin"))
+	return fileID, nil
+}
+
+// TusDelete aborts an upload and discards the staged data (termination extension)
+func TusDelete(w http.ResponseWriter, r *http.Request, userID int) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	upload := lookupTusUpload(w, r, userID)
+	if upload == nil {
+		return
+	}
+	upload.remove()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeExpiredUploads removes staged uploads past their Upload-Expires time
+func PurgeExpiredUploads() error {
+	infos, err := filepath.Glob(filepath.Join(tusDir, "*.info"))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		upload, err := loadTusUpload(strings.TrimSuffix(filepath.Base(info), ".info"))
+		if err != nil {
+			log.Printf("error reading resumable upload %s: %v", info, err)
+			continue
+		}
+		if time.Now().After(upload.ExpiresAt) {
+			log.Printf("Removing expired resumable upload %s", upload.ID)
+			upload.remove()
+		}
+	}
+	return nil
+}
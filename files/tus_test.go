@@ -0,0 +1,151 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"reflect"
+	"shareit/encryption"
+	"testing"
+)
+
+// useTestKeyring points the encryption package at an in-memory keyring
+func useTestKeyring(t *testing.T) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyring, err := encryption.LoadKeyring("", "v1:"+base64.StdEncoding.EncodeToString(key), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := encryption.Keys
+	encryption.Keys = keyring
+	t.Cleanup(func() { encryption.Keys = previous })
+}
+
+// TestTusChunkOffsets appends an upload in chunks that split AES blocks at arbitrary offsets and
+// checks that the staged ciphertext is one continuous CTR stream
+func TestTusChunkOffsets(t *testing.T) {
+	useTestKeyring(t)
+	previousDir := tusDir
+	tusDir = t.TempDir()
+	t.Cleanup(func() { tusDir = previousDir })
+
+	ctx := context.Background()
+	plain := make([]byte, 1000)
+	rand.Read(plain)
+
+	tests := []struct {
+		name   string
+		iv     []byte
+		chunks []int
+	}{
+		{"one chunk", nil, []int{1000}},
+		{"block aligned", nil, []int{16, 32, 952}},
+		{"unaligned", nil, []int{1, 15, 17, 100, 867}},
+		{"single bytes then the rest", nil, []int{1, 1, 1, 997}},
+		{"counter carries into the high half", bytes.Repeat([]byte{0xff}, 16), []int{7, 40, 953}},
+		{"low half about to wrap", append(make([]byte, 8), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe), []int{20, 13, 967}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, wrapped, keyID, err := encryption.NewDataKey(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			iv := tt.iv
+			if iv == nil {
+				iv = make([]byte, aes.BlockSize)
+				rand.Read(iv)
+			}
+			u := &tusUpload{ID: "0" + string(rune('a'+i)), Length: int64(len(plain)), WrappedKey: wrapped, KeyID: keyID, IV: iv}
+			if err := os.WriteFile(tusPath(u.ID, ".bin"), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			offset := int64(0)
+			for _, size := range tt.chunks {
+				next, err := u.appendChunk(ctx, bytes.NewReader(plain[offset:offset+int64(size)]), offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if next != offset+int64(size) {
+					t.Fatalf("offset after chunk = %d, want %d", next, offset+int64(size))
+				}
+				offset = next
+			}
+			if got, err := u.offset(); err != nil || got != int64(len(plain)) {
+				t.Fatalf("offset() = %d, %v", got, err)
+			}
+
+			stream, err := u.stream(ctx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(tusPath(u.ID, ".bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := io.ReadAll(cipher.StreamReader{S: stream, R: f})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatal("staged data does not decrypt to the uploaded bytes")
+			}
+		})
+	}
+}
+
+func TestTusChunkStopsAtLength(t *testing.T) {
+	useTestKeyring(t)
+	previousDir := tusDir
+	tusDir = t.TempDir()
+	t.Cleanup(func() { tusDir = previousDir })
+
+	ctx := context.Background()
+	_, wrapped, keyID, err := encryption.NewDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &tusUpload{ID: "0f", Length: 10, WrappedKey: wrapped, KeyID: keyID, IV: make([]byte, aes.BlockSize)}
+	os.WriteFile(tusPath(u.ID, ".bin"), nil, 0o600)
+	offset, err := u.appendChunk(ctx, bytes.NewReader(make([]byte, 25)), 4)
+	if err != nil || offset != 10 {
+		t.Fatalf("appendChunk = %d, %v, want 10", offset, err)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	enc := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"one pair", "filename " + enc("a.txt"), map[string]string{"filename": "a.txt"}, false},
+		{"several pairs", "filename " + enc("a b.txt") + ", folder_id " + enc("7"), map[string]string{"filename": "a b.txt", "folder_id": "7"}, false},
+		{"key without value", "is_confidential", map[string]string{"is_confidential": ""}, false},
+		{"invalid base64", "filename ***", nil, true},
+		{"trailing comma", "filename " + enc("a.txt") + ",", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTusMetadata(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseTusMetadata = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
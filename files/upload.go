@@ -1,158 +1,410 @@
 package files
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"bufio"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path/filepath"
 	"shareit/db"
+	"shareit/encryption"
+	"shareit/storage"
+	"strconv"
 	"time"
 )
 
-// File represents a file record
+// File represents a file record together with its current version
 type File struct {
     ID        int       `json:"id"`
     Filename  string    `json:"filename"`
     FileType  string    `json:"file_type"`
-    FilePath  string    `json:"file_path"`
+	ObjectKey string    `json:"-"` // internal; exposing it would reveal which uploads share a blob
     UserID    int       `json:"user_id"`
+	FolderID  *int      `json:"folder_id"`
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	Role      string    `json:"role,omitempty"`
     CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// EncryptFile encrypts the file data using AES encryption
-func EncryptFile(file multipart.File, key []byte) ([]byte, error) {
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        return nil, err
-    }
+// fileTables joins every file to its current version; fileColumns are the columns read by scanFile
+const (
+	fileTables  = "files f JOIN file_versions v ON v.id = f.current_version_id JOIN blobs b ON b.id = v.blob_id"
+	fileColumns = "f.id, f.filename, v.file_type, b.object_key, f.user_id, f.folder_id, v.version, b.size, f.created_at, f.updated_at"
+)
 
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
+// scanFile reads a row selected with fileColumns followed by any extra columns
+func scanFile(rows *sql.Rows, extra ...interface{}) (File, error) {
+	var file File
+	var folderID sql.NullInt64
+	var createdAtStr, updatedAtStr string
+	dest := append([]interface{}{&file.ID, &file.Filename, &file.FileType, &file.ObjectKey, &file.UserID, &folderID,
+		&file.Version, &file.Size, &createdAtStr, &updatedAtStr}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return file, err
+	}
+	if folderID.Valid {
+		id := int(folderID.Int64)
+		file.FolderID = &id
+	}
+	file.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+	file.UpdatedAt, _ = time.Parse("2006-01-02 15:04:05", updatedAtStr)
+	return file, nil
+}
 
-    nonce := make([]byte, gcm.NonceSize())
-    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-        return nil, err
-    }
+// upload describes where an incoming file goes
+type upload struct {
+	UserID   int  // uploader
+	FolderID *int // folder for a new file, nil for the root
+	FileID   int  // existing file to add a version to; 0 adds to a file with the same name in FolderID, or creates one
+	Filename string
+}
 
-    fileData, err := io.ReadAll(file)
-    if err != nil {
-        return nil, err
-    }
+// storedFile is the outcome of storeFile
+type storedFile struct {
+	FileID    int    `json:"file_id"`
+	Version   int    `json:"version"`
+	ObjectKey string `json:"-"`
+	Size      int64  `json:"size"`
+}
+
+// encryptToStorage encrypts src as it streams into the storage backend under objectKey
+func encryptToStorage(ctx context.Context, objectKey string, src io.Reader, key []byte, keyID string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := encryption.NewWriter(pw, key, keyID)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(enc, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(enc.Close())
+	}()
 
-    encrypted := gcm.Seal(nonce, nonce, fileData, nil)
-    return encrypted, nil
+	err := storage.Default.Put(ctx, objectKey, pr)
+	// Unblock the encrypting goroutine if the backend stopped reading early
+	pr.CloseWithError(err)
+	return err
 }
 
-// DecryptFile decrypts the encrypted file data using AES-GCM
-func DecryptFile(encryptedData []byte, key []byte) ([]byte, error) {
-    block, err := aes.NewCipher(key)
-    if err != nil {
+// openDecrypted opens the blob at objectKey for random access to its plaintext. The data key is
+// unwrapped with the configured KeyProvider; the returned closer releases the blob.
+func openDecrypted(ctx context.Context, objectKey string, wrappedKey []byte, keyID string) (*encryption.ReaderAt, io.Closer, error) {
+	dataKey, err := encryption.Keys.UnwrapKey(ctx, keyID, wrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+
+	blob, info, err := storage.OpenReaderAt(ctx, storage.Default, objectKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening encrypted file: %w", err)
+	}
+
+	decrypted, err := encryption.NewReaderAt(blob, info.Size, dataKey)
+	if err == nil && decrypted.Header().KeyID != encryption.KeyFingerprint(dataKey) {
+		err = errors.New("data key does not match the encrypted file")
+	}
+	if err != nil {
+		blob.Close()
+		return nil, nil, err
+	}
+	return decrypted, blob, nil
+}
+
+// detectContentType guesses the MIME type from the file extension, falling back to sniffing the
+// first bytes of the upload. The sniffed bytes stay in the returned reader.
+func detectContentType(filename string, src io.Reader) (string, io.Reader) {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType, src
+	}
+	buffered := bufio.NewReaderSize(src, 512)
+	head, _ := buffered.Peek(512)
+	return http.DetectContentType(head), buffered
+}
+
+// nextFilePart advances the multipart stream to the "file" part without buffering the upload.
+// Plain form fields sent before the file (such as folder_id) are returned alongside it.
+func nextFilePart(r *http.Request) (*multipart.Part, map[string]string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, fields, nil
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				return nil, nil, err
+			}
+			fields[part.FormName()] = string(value)
+		}
+		part.Close()
+	}
+}
+
+// parseFolderID validates an optional folder id belonging to userID; empty means the root folder
+func parseFolderID(ctx context.Context, value string, userID int) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	folderID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errFolderNotFound
+	}
+	if err := checkFolderOwner(ctx, folderID, userID); err != nil {
         return nil, err
     }
+	return &folderID, nil
+}
 
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
+// storeFile encrypts src into the storage backend and records it as a new version. It is the
+// single ingest path shared by multipart uploads and completed resumable uploads.
+func storeFile(ctx context.Context, u upload, src io.Reader) (storedFile, error) {
+	// Stop reading as soon as the upload outgrows the owner's remaining quota
+	ownerID, _, err := uploadOwner(ctx, u)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("error resolving upload target: %w", err)
+	}
+	usage, err := userUsage(ctx, ownerID)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("error retrieving storage usage: %w", err)
+	}
+	if remaining := usage.remainingBytes(); remaining >= 0 {
+		src = &quotaReader{r: src, remaining: remaining}
     }
 
-    nonceSize := gcm.NonceSize()
-    if len(encryptedData) < nonceSize {
-        return nil, fmt.Errorf("encrypted data too short")
+	contentType, src := detectContentType(u.Filename, src)
+
+	// Generate a random data key for this version, wrapped by the current master key
+	dataKey, wrappedKey, keyID, err := encryption.NewDataKey(ctx)
+    if err != nil {
+		return storedFile{}, fmt.Errorf("error generating data key: %w", err)
     }
 
-    nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
+	// Every upload is written under a fresh object key, so it never overwrites an existing blob
+	objectKey, err := newObjectKey(u.UserID)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("error generating object key: %w", err)
+	}
 
-    decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
+	// Encrypt the upload while it streams to the storage backend, hashing the plaintext on the way
+	hashed := newHashingReader(src)
+	err = encryptToStorage(ctx, objectKey, hashed, dataKey, encryption.KeyFingerprint(dataKey))
     if err != nil {
-        return nil, err
+		return storedFile{}, fmt.Errorf("error storing encrypted file: %w", err)
     }
 
-    return decrypted, nil
+	b := blob{ContentHash: hashed.Sum(), ObjectKey: objectKey, WrappedKey: wrappedKey, KeyID: keyID, Size: hashed.n}
+	stored, err := recordVersion(ctx, u, b, contentType)
+	if err != nil || stored.ObjectKey != objectKey {
+		// Do not leave an unreferenced blob behind; a duplicate is served from the existing blob
+		if err := storage.Default.Delete(ctx, objectKey); err != nil {
+			log.Println("Error deleting redundant blob:", err)
+		}
+	}
+	return stored, err
 }
 
+// recordVersion saves b as the new current version of the target file, creating the file if needed.
+// If the same content is already stored in the uploader's dedup scope, that blob is referenced instead.
+func recordVersion(ctx context.Context, u upload, b blob, contentType string) (storedFile, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return storedFile{}, err
+	}
+	defer tx.Rollback()
 
-func SaveFile(w http.ResponseWriter, r *http.Request, userID int) {
-    file, header, err := r.FormFile("file")
-    if err != nil {
-        log.Println("Error retrieving file from form:", err)
-        http.Error(w, "Invalid file upload", http.StatusBadRequest)
-        return
+	fileID := u.FileID
+	ownerID := u.UserID
+	var newFiles int64
+	if fileID != 0 {
+		// Lock the file so concurrent uploads get consecutive version numbers
+		err = tx.QueryRowContext(ctx, "SELECT id, user_id FROM files WHERE id = ? AND deleted_at IS NULL FOR UPDATE", fileID).Scan(&fileID, &ownerID)
+	} else {
+		err = tx.QueryRowContext(ctx, "SELECT id FROM files WHERE user_id = ? AND folder_id <=> ? AND filename = ? AND deleted_at IS NULL LIMIT 1 FOR UPDATE",
+			u.UserID, u.FolderID, u.Filename).Scan(&fileID)
+		if err == sql.ErrNoRows {
+			var result sql.Result
+			result, err = tx.ExecContext(ctx, "INSERT INTO files (filename, user_id, folder_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+				u.Filename, u.UserID, u.FolderID, time.Now(), time.Now())
+			if err == nil {
+				var id int64
+				id, err = result.LastInsertId()
+				fileID = int(id)
+				newFiles = 1
+			}
+		}
+	}
+	if err != nil {
+		return storedFile{}, fmt.Errorf("error saving encrypted file metadata: %w", err)
     }
-    defer file.Close()
 
-    // Define where to store the encrypted file on the server
-    encryptedFilePath := fmt.Sprintf("./uploads/%d_%s.enc", userID, header.Filename)
-    outFile, err := os.Create(encryptedFilePath)
+	b, err = claimBlob(ctx, tx, u.UserID, b)
     if err != nil {
-        log.Println("Error creating encrypted file:", err)
-        http.Error(w, "Unable to save file", http.StatusInternalServerError)
-        return
+		return storedFile{}, err
+	}
+	// The version is charged to the file's owner with its full size, shared blob or not
+	if err := chargeUsage(ctx, tx, ownerID, b.Size, newFiles); err != nil {
+		return storedFile{}, err
+	}
+	version, err := addVersion(ctx, tx, fileID, b.ID, contentType, u.UserID)
+	if err != nil {
+		return storedFile{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return storedFile{}, fmt.Errorf("error saving encrypted file metadata: %w", err)
     }
-    defer outFile.Close()
 
-    // Generate a 32-byte encryption key (this should be stored securely)
-    encryptionKey := []byte("this_is_a_32_byte_key_for_aes_on") // Replace this with a secure key management strategy
+	invalidateSearchCache(ctx, fileID)
+	return storedFile{FileID: fileID, Version: version, ObjectKey: b.ObjectKey, Size: b.Size}, nil
+}
 
-    // Encrypt the file data
-    encryptedData, err := EncryptFile(file, encryptionKey)
-    if err != nil {
-        log.Println("Error encrypting file:", err)
-        http.Error(w, "Unable to encrypt file", http.StatusInternalServerError)
-        return
-    }
+// addVersion inserts the blob as the next version of fileID and makes it current. fileID must be
+// locked by tx and the caller must hold a reference on the blob for the new version.
+func addVersion(ctx context.Context, tx *sql.Tx, fileID int, blobID int, fileType string, createdBy int) (int, error) {
+	var version int
+	err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = ?", fileID).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error numbering file version: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO file_versions (file_id, version, blob_id, file_type, created_by, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`,
+		fileID, version, blobID, fileType, createdBy, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error saving file version: %w", err)
+	}
+	versionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving version ID: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE files SET current_version_id = ?, updated_at = ? WHERE id = ?", versionID, time.Now(), fileID)
+	if err != nil {
+		return 0, fmt.Errorf("error updating current version: %w", err)
+	}
+	return version, nil
+}
+
+// uploadOwner resolves whose quota an upload is charged to and whether it creates a new file
+func uploadOwner(ctx context.Context, u upload) (int, bool, error) {
+	if u.FileID != 0 {
+		var ownerID int
+		err := db.DB.QueryRowContext(ctx, "SELECT user_id FROM files WHERE id = ?", u.FileID).Scan(&ownerID)
+		return ownerID, false, err
+	}
+	var fileID int
+	err := db.DB.QueryRowContext(ctx, "SELECT id FROM files WHERE user_id = ? AND folder_id <=> ? AND filename = ? AND deleted_at IS NULL LIMIT 1",
+		u.UserID, u.FolderID, u.Filename).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return u.UserID, true, nil
+	}
+	return u.UserID, false, err
+}
 
-    // Write the encrypted data to the file
-    _, err = outFile.Write(encryptedData)
+// precheckUpload rejects an upload of size bytes (-1 if unknown) that cannot fit the owner's quota before
+// its body is read
+func precheckUpload(ctx context.Context, u upload, size int64) error {
+	ownerID, newFile, err := uploadOwner(ctx, u)
+	if err != nil {
+		return err
+	}
+	return checkQuota(ctx, ownerID, size, newFile)
+}
+
+// multipartOverhead is how much of a multipart request's length uploadSize attributes to the
+// boundaries, part headers and form fields rather than the file
+const multipartOverhead = 16 << 10
+
+// uploadSize estimates the size of the file in part from below, or returns -1 if it is unknown.
+// Browsers send no Content-Length on the part, so the request length less the multipart overhead
+// stands in for it; a file under-estimated that way is still cut off by storeFile.
+func uploadSize(r *http.Request, part *multipart.Part) int64 {
+	if n, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	if r.ContentLength < 0 {
+		return -1
+	}
+	if r.ContentLength < multipartOverhead {
+		return 0
+	}
+	return r.ContentLength - multipartOverhead
+}
+
+// SaveFile stores an upload. Optional form fields sent before the file: file_id adds a new version
+// to an existing file (requires editor), folder_id places a new file in one of the user's folders.
+// Uploading a name that already exists in the folder adds a version to that file.
+func SaveFile(w http.ResponseWriter, r *http.Request, userID int) {
+	part, fields, err := nextFilePart(r)
     if err != nil {
-        log.Println("Error writing encrypted data to file:", err)
-        http.Error(w, "Unable to save encrypted file", http.StatusInternalServerError)
+        log.Println("Error retrieving file from form:", err)
+        http.Error(w, "Invalid file upload", http.StatusBadRequest)
         return
     }
+	defer part.Close()
 
-    // Save encrypted file metadata to the database and retrieve file ID
-    result, err := db.DB.Exec("INSERT INTO files (filename, file_type, file_path, user_id, created_at) VALUES (?, ?, ?, ?, ?)",
-        header.Filename, http.DetectContentType([]byte(header.Filename)), encryptedFilePath, userID, time.Now())
-    if err != nil {
-        log.Println("Error saving encrypted file metadata:", err)
-        http.Error(w, "Unable to save file metadata", http.StatusInternalServerError)
-        return
+	u := upload{UserID: userID, Filename: part.FileName()}
+	if fields["file_id"] != "" {
+		u.FileID, err = strconv.Atoi(fields["file_id"])
+		if err != nil {
+			http.Error(w, "Invalid file_id", http.StatusBadRequest)
+			return
+		}
+		if !authorize(w, r, userID, u.FileID, RoleEditor) {
+			return
+		}
+	} else {
+		u.FolderID, err = parseFolderID(r.Context(), fields["folder_id"], userID)
+		if err != nil {
+			writeFolderError(w, err)
+			return
+		}
     }
 
-    // Get the last inserted file ID
-    fileID, err := result.LastInsertId()
-    if err != nil {
-        log.Println("Error retrieving file ID:", err)
+	// Only the part headers have been read so far; storeFile enforces the quota while streaming
+	err = precheckUpload(r.Context(), u, uploadSize(r, part))
+	if writeQuotaError(w, err) {
+		return
+	} else if err != nil {
+		log.Println("Error checking storage quota:", err)
         http.Error(w, "Internal server error", http.StatusInternalServerError)
         return
     }
 
-    // Generate the absolute path for the file on the server
-    absPath, err := filepath.Abs(encryptedFilePath)
-    if err != nil {
-        log.Println("Error getting absolute file path:", err)
-        http.Error(w, "Internal server error", http.StatusInternalServerError)
+	stored, err := storeFile(r.Context(), u, part)
+	if writeQuotaError(w, err) {
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
         return
     }
 
-    // Generate the publicly accessible URL
-    publicURL := fmt.Sprintf("http://localhost:8080/files/access/%d", fileID)
-
-    // Return the success message, file path, and public URL
-    response := map[string]string{
+	// Return the success message and the stored version; public links are created with ShareFile
+	response := map[string]interface{}{
         "message": "File uploaded and encrypted successfully",
-        "file_path": absPath,
-        "public_url": publicURL,
+		"file_id": stored.FileID,
+		"version": stored.Version,
     }
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(response)
 }
-
@@ -0,0 +1,244 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shareit/db"
+	"strconv"
+	"time"
+)
+
+// FileVersion is one stored revision of a file
+type FileVersion struct {
+	Version   int       `json:"version"`
+	FileType  string    `json:"file_type"`
+	Size      int64     `json:"size"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
+}
+
+// versionParam reads the optional version query parameter; 0 means the current version
+func versionParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("version")
+	if value == "" {
+		return 0, true
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return 0, false
+	}
+	return version, true
+}
+
+// ListVersions lists every retained version of a file, newest first (viewer access)
+func ListVersions(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok || !authorize(w, r, userID, fileID, RoleViewer) {
+		return
+	}
+
+	rows, err := db.DB.Query(`SELECT v.version, v.file_type, b.size, v.created_by, v.created_at, v.id = f.current_version_id
+		FROM file_versions v JOIN files f ON f.id = v.file_id JOIN blobs b ON b.id = v.blob_id WHERE v.file_id = ? ORDER BY v.version DESC`, fileID)
+	if err != nil {
+		log.Println("Error retrieving file versions:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []FileVersion{}
+	for rows.Next() {
+		var v FileVersion
+		var createdAtStr string
+		if err := rows.Scan(&v.Version, &v.FileType, &v.Size, &v.CreatedBy, &createdAtStr, &v.Current); err != nil {
+			log.Println("Error scanning file version:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		v.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
+		versions = append(versions, v)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(versions)
+}
+
+// RestoreVersion makes an old version current again by recording it as a new version (editor access).
+// The restored version references the old version's blob, so nothing is re-encrypted or copied.
+func RestoreVersion(w http.ResponseWriter, r *http.Request, userID int) {
+	fileID, ok := fileIDParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := versionParam(w, r)
+	if !ok {
+		return
+	}
+	if version == 0 {
+		http.Error(w, "version is required", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, r, userID, fileID, RoleEditor) {
+		return
+	}
+
+	tx, err := db.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		log.Println("Error restoring file version:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the file so the restore gets the next version number
+	var newVersion, ownerID, blobID int
+	var fileType string
+	var size int64
+	err = tx.QueryRowContext(r.Context(), `SELECT f.user_id, v.blob_id, v.file_type, b.size
+		FROM files f JOIN file_versions v ON v.file_id = f.id JOIN blobs b ON b.id = v.blob_id
+		WHERE f.id = ? AND v.version = ? FOR UPDATE`, fileID, version).
+		Scan(&ownerID, &blobID, &fileType, &size)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error retrieving file version:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Like an upload, the restored version counts against the owner's quota
+	err = chargeUsage(r.Context(), tx, ownerID, size, 0)
+	if err == nil {
+		err = retainBlob(r.Context(), tx, blobID)
+	}
+	if err == nil {
+		newVersion, err = addVersion(r.Context(), tx, fileID, blobID, fileType, userID)
+	}
+	if writeQuotaError(w, err) {
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error restoring file version:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	invalidateSearchCache(r.Context(), fileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Version restored successfully",
+		"file_id":       fileID,
+		"version":       newVersion,
+		"restored_from": version,
+	})
+}
+
+// PruneVersions applies the version retention policy: of every file only the newest keep versions
+// are retained, and versions older than maxAge are dropped. A zero keep or maxAge disables that
+// rule. The current version is never pruned. Blobs are removed once no version references them.
+func PruneVersions(ctx context.Context, keep int, maxAge time.Duration) (int, error) {
+	if keep <= 0 && maxAge <= 0 {
+		return 0, nil
+	}
+
+	// Current versions are always the newest, so they count as rank 1 of their file
+	rows, err := db.DB.QueryContext(ctx, `SELECT v.id, v.file_id, v.blob_id, v.created_at
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.id <> f.current_version_id ORDER BY v.file_id, v.version DESC`)
+	if err != nil {
+		return 0, fmt.Errorf("error querying file versions: %w", err)
+	}
+
+	type prunable struct {
+		id     int
+		blobID int
+	}
+	var expired []prunable
+	cutoff := time.Now().Add(-maxAge)
+	lastFileID, rank := 0, 1
+	for rows.Next() {
+		var p prunable
+		var fileID int
+		var createdAtStr string
+		if err := rows.Scan(&p.id, &fileID, &p.blobID, &createdAtStr); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning file version: %w", err)
+		}
+		if fileID != lastFileID {
+			lastFileID, rank = fileID, 1
+		}
+		rank++
+
+		createdAt, _ := time.Parse("2006-01-02 15:04:05", createdAtStr)
+		if (keep > 0 && rank > keep) || (maxAge > 0 && createdAt.Before(cutoff)) {
+			expired = append(expired, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error querying file versions: %w", err)
+	}
+
+	pruned := 0
+	for _, p := range expired {
+		removed, err := pruneVersion(ctx, p.id, p.blobID)
+		if err != nil {
+			return pruned, err
+		}
+		if !removed {
+			continue
+		}
+		if err := deleteBlob(ctx, p.blobID); err != nil {
+			log.Println(err)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// pruneVersion deletes a non-current version, releases its blob reference and credits the owner's usage
+func pruneVersion(ctx context.Context, versionID, blobID int) (bool, error) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The current_version_id check guards against a restore that happened since the query
+	var ownerID int
+	var size int64
+	err = tx.QueryRowContext(ctx, `SELECT f.user_id, b.size FROM file_versions v
+		JOIN files f ON f.id = v.file_id JOIN blobs b ON b.id = v.blob_id
+		WHERE v.id = ? AND v.id <> f.current_version_id FOR UPDATE`, versionID).Scan(&ownerID, &size)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error retrieving file version %d: %w", versionID, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM file_versions WHERE id = ?", versionID)
+	if err != nil {
+		return false, fmt.Errorf("error deleting file version %d: %w", versionID, err)
+	}
+	if err := releaseBlob(ctx, tx, blobID); err != nil {
+		return false, err
+	}
+	if err := releaseUsage(ctx, tx, ownerID, size, 0); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error deleting file version %d: %w", versionID, err)
+	}
+	return true, nil
+}
@@ -1,16 +1,205 @@
+-- Creates the tables that do not exist yet. A database created by an earlier version of this file
+-- also needs "shareit migrate" afterwards to add new columns and move legacy uploads.
+
 CREATE TABLE IF NOT EXISTS users (
     id INT AUTO_INCREMENT PRIMARY KEY,
     email VARCHAR(255) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
+    role ENUM('user', 'admin', 'auditor') NOT NULL DEFAULT 'user',
+    -- Suspended accounts can neither log in nor use their tokens
+    suspended_at DATETIME NULL,
+    -- NULL until the address is confirmed through a verification link (or a password reset)
+    email_verified_at DATETIME NULL,
+    -- TOTP secret wrapped by the master key provider; enabled once a code was confirmed
+    totp_secret VARBINARY(512) NULL,
+    totp_key_id VARCHAR(64) NULL,
+    totp_enabled_at DATETIME NULL,
+    -- Time step of the last accepted code, so a code cannot be replayed
+    totp_last_step BIGINT NULL,
+    -- NULL quotas fall back to QUOTA_DEFAULT_BYTES / QUOTA_DEFAULT_FILES; 0 is unlimited
+    quota_bytes BIGINT NULL,
+    quota_files INT NULL,
+    used_bytes BIGINT NOT NULL DEFAULT 0,
+    used_files INT NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE IF NOT EXISTS folders (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    parent_id INT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (parent_id) REFERENCES folders(id)
+);
+
 CREATE TABLE IF NOT EXISTS files (
     id INT AUTO_INCREMENT PRIMARY KEY,
     filename VARCHAR(255),
-    file_type VARCHAR(50),
-    file_path VARCHAR(255),
     user_id INT,
+    folder_id INT NULL,
+    current_version_id INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- Set while the file is in the trash
+    deleted_at DATETIME NULL,
+    deleted_by INT NULL,
+    INDEX (current_version_id),
+    INDEX (deleted_at),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (folder_id) REFERENCES folders(id)
+);
+
+-- Encrypted objects, content-addressed within a dedup scope ('user:<id>' or 'global'); content_hash
+-- is NULL when deduplication is off. ref_count is the number of file_versions rows using the blob.
+CREATE TABLE IF NOT EXISTS blobs (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    scope VARCHAR(64) NOT NULL,
+    content_hash CHAR(64) NULL,
+    object_key VARCHAR(255) NOT NULL UNIQUE,
+    wrapped_key VARBINARY(512) NOT NULL,
+    key_id VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (scope, content_hash),
+    INDEX (key_id),
+    INDEX (ref_count)
+);
+
+-- Every upload of a file is a version; files.current_version_id points at the one served by default.
+-- Versions with the same content (including restored versions) share a blob.
+CREATE TABLE IF NOT EXISTS file_versions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    file_id INT NOT NULL,
+    version INT NOT NULL,
+    blob_id INT NOT NULL,
+    file_type VARCHAR(255),
+    created_by INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (file_id, version),
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    FOREIGN KEY (blob_id) REFERENCES blobs(id),
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS shares (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    file_id INT NOT NULL,
+    created_by INT NOT NULL,
+    expires_at DATETIME NULL,
+    max_downloads INT NULL,
+    download_count INT NOT NULL DEFAULT 0,
+    password_hash VARCHAR(255) NULL,
+    revoked_at DATETIME NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (user_id) REFERENCES users(id)
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS file_permissions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    file_id INT NOT NULL,
+    user_id INT NOT NULL,
+    role ENUM('viewer', 'editor', 'co-owner') NOT NULL,
+    granted_by INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (file_id, user_id),
+    FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users(id)
+);
+
+-- Refresh tokens are stored as SHA-256 hashes. Every refresh replaces the token with a new one in
+-- the same family; a reused token revokes the whole family.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    family_id VARCHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (family_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One session per refresh token family, i.e. per login on a device
+CREATE TABLE IF NOT EXISTS sessions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    family_id VARCHAR(32) NOT NULL UNIQUE,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL,
+    INDEX (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Single-use password reset tokens, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Single-use email verification tokens, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS email_verifications (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One-time MFA recovery codes, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME NOT NULL,
+    INDEX (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Personal access tokens for scripts and CI, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    -- Comma separated, e.g. files:read,files:write
+    scopes VARCHAR(255) NOT NULL,
+    expires_at DATETIME NULL,
+    last_used_at DATETIME NULL,
+    created_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL,
+    INDEX (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Single sign-on identities (OpenID Connect issuer + subject) linked to accounts
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NULL,
+    created_at DATETIME NOT NULL,
+    last_login_at DATETIME NULL,
+    UNIQUE (issuer, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
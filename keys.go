@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"shareit/auth"
+	"shareit/db"
+	"shareit/encryption"
+	"shareit/files"
+)
+
+// runKeysCommand implements the "shareit keys ..." operator commands
+func runKeysCommand(args []string) {
+	if len(args) == 0 || args[0] != "rotate" {
+		fmt.Fprintln(os.Stderr, "usage: shareit keys rotate [-batch N] [-resume]")
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("keys rotate", flag.ExitOnError)
+	batchSize := flags.Int("batch", 500, "number of data keys re-wrapped per transaction")
+	resume := flags.Bool("resume", false, "only re-wrap remaining data keys, do not create a new master key version")
+	flags.Parse(args[1:])
+
+	cfg := loadConfig(nil)
+	db.ConnectDB(cfg)
+	defer db.DB.Close()
+	encryption.Connect(cfg)
+
+	ctx := context.Background()
+	if !*resume {
+		keyID, err := encryption.Keys.Rotate(ctx)
+		if err != nil {
+			log.Fatal("Error rotating master key: ", err)
+		}
+		log.Println("New master key version:", keyID)
+	}
+
+	result, err := files.RewrapDataKeys(ctx, *batchSize, func(p files.RewrapProgress) {
+		log.Printf("Re-wrapped %d/%d data keys under %s (%d failed)", p.Done, p.Total, p.KeyID, p.Failed)
+	})
+	if err != nil {
+		log.Fatal("Error re-wrapping data keys: ", err)
+	}
+	if result.Failed > 0 {
+		log.Fatalf("%d data keys could not be re-wrapped; run \"shareit keys rotate -resume\" to retry", result.Failed)
+	}
+	log.Printf("Rotation complete: %d data keys now wrapped under %s", result.Done, result.KeyID)
+
+	secrets, err := auth.RewrapTOTPSecrets(ctx)
+	if err != nil {
+		log.Fatal("Error re-wrapping TOTP secrets: ", err)
+	}
+	log.Printf("Re-wrapped %d TOTP secrets", secrets)
+}
@@ -0,0 +1,50 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"shareit/config"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Default is the mailer selected by Connect
+var Default Mailer
+
+// Connect selects the mailer from MAIL_BACKEND: "outbox" writes messages to MAIL_OUTBOX_DIR (or only
+// logs their recipients when it is unset), "smtp" delivers through SMTP_ADDR. There is no default:
+// mails carry reset and verification tokens, so the development outbox must be chosen explicitly.
+func Connect(cfg *config.Config) {
+	from := cfg.MailFrom
+
+	switch cfg.MailBackend {
+	case "":
+		log.Fatal("MAIL_BACKEND is required: smtp, or outbox for development")
+	case "outbox":
+		dir := cfg.MailOutboxDir
+		Default = &Outbox{Dir: dir, From: from}
+		if dir == "" {
+			log.Println("Mail goes to the outbox; MAIL_OUTBOX_DIR is unset, so mails are dropped and only their recipients logged")
+		} else {
+			log.Println("Mail goes to the outbox in", dir)
+		}
+	case "smtp":
+		Default = &SMTP{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     from,
+		}
+		log.Println("Mail is delivered through", cfg.SMTPAddr)
+	}
+}
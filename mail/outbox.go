@@ -0,0 +1,44 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outbox is a development mailer: every message is written as an .eml file to Dir. When Dir is empty
+// only the recipient and subject are logged; bodies hold reset and verification tokens and must not
+// end up in the logs.
+type Outbox struct {
+	Dir  string
+	From string
+}
+
+// Send stores msg in the outbox
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	if o.Dir == "" {
+		log.Printf("Mail to %s: %s (body not logged, set MAIL_OUTBOX_DIR to keep it)", msg.To, msg.Subject)
+		return nil
+	}
+
+	if err := os.MkdirAll(o.Dir, 0o700); err != nil {
+		return fmt.Errorf("error creating mail outbox: %w", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+	path := filepath.Join(o.Dir, name)
+	if err := os.WriteFile(path, compose(o.From, msg), 0o600); err != nil {
+		return fmt.Errorf("error writing mail to outbox: %w", err)
+	}
+	log.Printf("Mail to %s written to %s", msg.To, path)
+	return nil
+}
@@ -3,28 +3,168 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"shareit/admin"
 	"shareit/auth"
+	"shareit/config"
 	"shareit/db"
+	"shareit/encryption"
 	"shareit/files"
+	"shareit/mail"
+	"shareit/rate_limiter"
+	"shareit/storage"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-
 func main() {
-    db.ConnectDB()
-    db.ConnectRedis()
+	// Operator commands, e.g. "shareit keys rotate"
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeysCommand(os.Args[2:])
+		return
+	}
+	// Upgrading a database created by an older init.sql
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+	// Bootstrapping admins, e.g. "shareit users set-role alice@example.com admin"
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		runUsersCommand(os.Args[2:])
+		return
+	}
+
+	cfg := loadConfig(os.Args[1:])
+	log.Printf("Effective configuration:\n%s", cfg.Dump())
+
+	db.ConnectDB(cfg)
+	db.ConnectRedis(cfg)
+	storage.Connect(cfg)
+	encryption.Connect(cfg)
+	mail.Connect(cfg)
+	auth.InitTokens(cfg)
+	auth.InitPasswordReset(cfg)
+	auth.InitEmailVerification(cfg)
+	auth.InitMFA(cfg)
+	auth.InitOIDC(cfg)
+	auth.InitLoginThrottling(cfg)
+	rate_limiter.InitTrustedProxies(cfg)
+	files.InitResumableUploads(cfg)
+	files.InitDeduplication(cfg)
+	files.InitQuotas(cfg)
+	files.InitSharing(cfg)
+
+	// Rate limits per route and method, counted per user for authenticated requests and per client
+	// address for the others; routes not listed share the default budget. Uploads are expensive,
+	// so they get a token bucket of their own.
+	uploads := rate_limiter.Policy{Name: "uploads", Limiter: rate_limiter.NewTokenBucket(120, time.Hour, 20)}
+	logins := rate_limiter.Policy{Name: "logins", Limiter: rate_limiter.NewSlidingWindowLog(20, time.Minute)}
+	emails := rate_limiter.Policy{Name: "emails", Limiter: rate_limiter.NewSlidingWindowLog(5, time.Hour)}
+	rate_limiter.Configure(
+		rate_limiter.Policy{Name: "default", Limiter: rate_limiter.NewSlidingWindowLog(100, time.Minute)},
+		rate_limiter.Policies{
+			"POST /files/upload":           uploads,
+			"POST /files/tus":              uploads,
+			"PATCH /files/tus/{upload_id}": {Name: "tus-chunks", Limiter: rate_limiter.NewTokenBucket(600, time.Minute, 100)},
+			"GET /files/search":            {Name: "search", Limiter: rate_limiter.NewSlidingWindowLog(60, time.Minute)},
+			"/files/download":              {Name: "downloads", Limiter: rate_limiter.NewTokenBucket(300, time.Minute, 60)},
+			"POST /files/share":            {Name: "shares", Limiter: rate_limiter.NewSlidingWindowLog(50, time.Hour)},
+			"POST /account/tokens":         {Name: "tokens", Limiter: rate_limiter.NewSlidingWindowLog(10, time.Hour)},
+			"POST /signup":                 {Name: "signups", Limiter: rate_limiter.NewSlidingWindowLog(5, time.Hour)},
+			"POST /login":                  logins,
+			"POST /login/mfa":              logins,
+			"POST /password/forgot":        emails,
+			"POST /verify-email/resend":    emails,
+			"/files/access/{token}":        {Name: "public-links", Limiter: rate_limiter.NewTokenBucket(60, time.Minute, 20)},
+		},
+	)
 
     router := mux.NewRouter()
 
-    router.HandleFunc("/signup", auth.SignupHandler).Methods("POST")
-    router.HandleFunc("/login", auth.LoginHandler).Methods("POST")
+	router.HandleFunc("/signup", rate_limiter.ByIP(auth.SignupHandler)).Methods("POST")
+	router.HandleFunc("/login", rate_limiter.ByIP(auth.LoginHandler)).Methods("POST")
+	router.HandleFunc("/login/mfa", rate_limiter.ByIP(auth.MFALoginHandler)).Methods("POST")
+	router.HandleFunc("/login/oidc", rate_limiter.ByIP(auth.OIDCLoginHandler)).Methods("GET")
+	router.HandleFunc("/login/oidc/callback", rate_limiter.ByIP(auth.OIDCCallbackHandler)).Methods("GET")
+	router.HandleFunc("/verify-email", rate_limiter.ByIP(auth.VerifyEmailHandler)).Methods("GET")
+	router.HandleFunc("/verify-email/resend", rate_limiter.ByIP(auth.ResendVerificationHandler)).Methods("POST")
+	router.HandleFunc("/password/forgot", rate_limiter.ByIP(auth.ForgotPasswordHandler)).Methods("POST")
+	router.HandleFunc("/password/reset", rate_limiter.ByIP(auth.ResetPasswordHandler)).Methods("POST")
+	router.HandleFunc("/token/refresh", rate_limiter.ByIP(auth.RefreshHandler)).Methods("POST")
+	router.HandleFunc("/logout", auth.RequireAuth(auth.LogoutHandler)).Methods("POST")
+
+	// Routes list the personal access token scopes they accept; routes without scopes (account
+	// management) need a login
+	router.HandleFunc("/files/upload", auth.RequireAuth(files.SaveFile, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/files/search", auth.RequireAuth(files.SearchFile, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/files/delete", auth.RequireAuth(files.DeleteFile, auth.ScopeFilesWrite)).Methods("DELETE")
+	router.HandleFunc("/files/rename", auth.RequireAuth(files.RenameFile, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/files/move", auth.RequireAuth(files.MoveFile, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/files/download", auth.RequireAuth(files.DownloadFile, auth.ScopeFilesRead)).Methods("GET", "HEAD")
+	router.HandleFunc("/files/shared-with-me", auth.RequireAuth(files.SharedWithMe, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/files/versions", auth.RequireAuth(files.ListVersions, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/files/versions/restore", auth.RequireAuth(files.RestoreVersion, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/files/permissions", auth.RequireAuth(files.ListPermissions, auth.ScopeSharesManage)).Methods("GET")
+	router.HandleFunc("/files/permissions", auth.RequireAuth(auth.RequireVerified(files.GrantPermission), auth.ScopeSharesManage)).Methods("POST")
+	router.HandleFunc("/files/permissions", auth.RequireAuth(files.RevokePermission, auth.ScopeSharesManage)).Methods("DELETE")
+	router.HandleFunc("/files/share", auth.RequireAuth(auth.RequireVerified(files.ShareFile), auth.ScopeSharesManage)).Methods("POST")
+	router.HandleFunc("/files/shares", auth.RequireAuth(files.ListShares, auth.ScopeSharesManage)).Methods("GET")
+	router.HandleFunc("/files/shares/revoke", auth.RequireAuth(files.RevokeShare, auth.ScopeSharesManage)).Methods("DELETE")
+	router.HandleFunc("/files/access/{token}", rate_limiter.ByIP(files.ServeFile)).Methods("GET", "HEAD")
+
+	router.HandleFunc("/trash/list", auth.RequireAuth(files.ListTrash, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/trash/restore", auth.RequireAuth(files.RestoreFile, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/trash/delete", auth.RequireAuth(files.PurgeFile, auth.ScopeFilesWrite)).Methods("DELETE")
 
-    router.HandleFunc("/files/upload", auth.RequireAuth(files.SaveFile)).Methods("POST")
-    router.HandleFunc("/files/search", auth.RequireAuth(files.SearchFile)).Methods("GET")
-    router.HandleFunc("/files/delete", auth.RequireAuth(files.DeleteFile)).Methods("DELETE")
-    router.HandleFunc("/files/share", auth.RequireAuth(files.ShareFile)).Methods("GET")
-	router.HandleFunc("/files/access/{file_id}", files.ServeFile).Methods("GET")
+	router.HandleFunc("/account/usage", auth.RequireAuth(files.GetUsage, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/account/mfa", auth.RequireAuth(auth.MFAStatus)).Methods("GET")
+	router.HandleFunc("/account/mfa/enroll", auth.RequireAuth(auth.EnrollMFA)).Methods("POST")
+	router.HandleFunc("/account/mfa/confirm", auth.RequireAuth(auth.ConfirmMFA)).Methods("POST")
+	router.HandleFunc("/account/mfa/disable", auth.RequireAuth(auth.DisableMFA)).Methods("POST")
+	router.HandleFunc("/account/mfa/recovery-codes", auth.RequireAuth(auth.RegenerateRecoveryCodes)).Methods("POST")
+	router.HandleFunc("/account/oidc/link", auth.RequireAuth(auth.LinkOIDCAccount)).Methods("POST")
+	router.HandleFunc("/account/tokens", auth.RequireAuth(auth.ListTokens)).Methods("GET")
+	router.HandleFunc("/account/tokens", auth.RequireAuth(auth.CreateToken)).Methods("POST")
+	router.HandleFunc("/account/tokens", auth.RequireAuth(auth.RevokeToken)).Methods("DELETE")
+	router.HandleFunc("/account/sessions", auth.RequireAuth(auth.ListSessions)).Methods("GET")
+	router.HandleFunc("/account/sessions", auth.RequireAuth(auth.RevokeSession)).Methods("DELETE")
+	router.HandleFunc("/account/sessions/others", auth.RequireAuth(auth.RevokeOtherSessions)).Methods("DELETE")
+
+	router.HandleFunc("/folders/list", auth.RequireAuth(files.ListFolder, auth.ScopeFilesRead)).Methods("GET")
+	router.HandleFunc("/folders/create", auth.RequireAuth(files.CreateFolder, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/folders/rename", auth.RequireAuth(files.RenameFolder, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/folders/move", auth.RequireAuth(files.MoveFolder, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/folders/delete", auth.RequireAuth(files.DeleteFolder, auth.ScopeFilesWrite)).Methods("DELETE")
+
+	// Admin API; auditors may only read
+	staff := []string{auth.RoleAdmin, auth.RoleAuditor}
+	router.HandleFunc("/admin/users", auth.RequireAuth(auth.RequireRole(admin.ListUsers, staff...))).Methods("GET")
+	router.HandleFunc("/admin/users/usage", auth.RequireAuth(auth.RequireRole(admin.GetUserUsage, staff...))).Methods("GET")
+	router.HandleFunc("/admin/users/suspend", auth.RequireAuth(auth.RequireRole(admin.SuspendUser, auth.RoleAdmin))).Methods("POST")
+	router.HandleFunc("/admin/users/reactivate", auth.RequireAuth(auth.RequireRole(admin.ReactivateUser, auth.RoleAdmin))).Methods("POST")
+	router.HandleFunc("/admin/users/role", auth.RequireAuth(auth.RequireRole(admin.SetUserRole, auth.RoleAdmin))).Methods("POST")
+	router.HandleFunc("/admin/users/reset-password", auth.RequireAuth(auth.RequireRole(admin.ResetUserPassword, auth.RoleAdmin))).Methods("POST")
+	router.HandleFunc("/admin/files", auth.RequireAuth(auth.RequireRole(admin.DeleteFile, auth.RoleAdmin))).Methods("DELETE")
+
+	// Resumable uploads (tus 1.0.0)
+	router.HandleFunc("/files/tus", files.TusOptions).Methods("OPTIONS")
+	router.HandleFunc("/files/tus", auth.RequireAuth(files.TusCreate, auth.ScopeFilesWrite)).Methods("POST")
+	router.HandleFunc("/files/tus/{upload_id}", files.TusOptions).Methods("OPTIONS")
+	router.HandleFunc("/files/tus/{upload_id}", auth.RequireAuth(files.TusHead, auth.ScopeFilesWrite)).Methods("HEAD")
+	router.HandleFunc("/files/tus/{upload_id}", auth.RequireAuth(files.TusPatch, auth.ScopeFilesWrite)).Methods("PATCH")
+	router.HandleFunc("/files/tus/{upload_id}", auth.RequireAuth(files.TusDelete, auth.ScopeFilesWrite)).Methods("DELETE")
+
+	log.Println("Listening on", cfg.ListenAddr)
+	log.Fatal(http.ListenAndServe(cfg.ListenAddr, router))
+}
 
-    log.Fatal(http.ListenAndServe(":8080", router))
+// loadConfig loads the configuration from the config file, the environment and args, or exits
+// with what is wrong with it
+func loadConfig(args []string) *config.Config {
+	cfg, err := config.Load(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
 }
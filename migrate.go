@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"shareit/db"
+	"shareit/encryption"
+	"shareit/files"
+	"shareit/storage"
+	"strings"
+)
+
+// runMigrateCommand implements "shareit migrate", which upgrades a database created by an older
+// init.sql: it adds the missing columns, moves the files uploaded by the original version into the
+// blob store and finally drops the legacy files.file_path and files.file_type columns
+func runMigrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	legacyKeyFile := flags.String("legacy-key-file", "", "file holding the 32-byte key legacy uploads are encrypted with (default: the key of the original version)")
+	flags.Parse(args)
+
+	legacyKey := []byte(files.LegacyKey)
+	if *legacyKeyFile != "" {
+		data, err := os.ReadFile(*legacyKeyFile)
+		if err != nil {
+			log.Fatal("Error reading legacy key: ", err)
+		}
+		legacyKey = []byte(strings.TrimRight(string(data), "\r\n"))
+	}
+	if len(legacyKey) != 32 {
+		log.Fatal("The legacy key must be 32 bytes")
+	}
+
+	cfg := loadConfig(nil)
+	db.ConnectDB(cfg)
+	defer db.DB.Close()
+	storage.Connect(cfg)
+	encryption.Connect(cfg)
+	files.InitDeduplication(cfg)
+
+	ctx := context.Background()
+	if err := db.UpgradeSchema(ctx); err != nil {
+		log.Fatal("Error upgrading schema: ", err)
+	}
+
+	legacy, err := db.ColumnExists(ctx, "files", "file_path")
+	if err != nil {
+		log.Fatal("Error inspecting schema: ", err)
+	}
+	if legacy {
+		result, err := files.MigrateLegacyFiles(ctx, legacyKey, func(p files.MigrateProgress) {
+			log.Printf("Migrated %d/%d legacy files (%d failed)", p.Done, p.Total, p.Failed)
+		})
+		if err != nil {
+			log.Fatal("Error migrating legacy files: ", err)
+		}
+		if result.Failed > 0 {
+			log.Fatalf("%d legacy files could not be migrated; fix them and run \"shareit migrate\" again", result.Failed)
+		}
+		// Only now is nothing left that needs the legacy columns
+		for _, column := range []string{"file_path", "file_type"} {
+			if err := db.DropColumn(ctx, "files", column); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Printf("Migrated %d legacy files; the original .enc files can be deleted once the migrated files were checked", result.Done)
+	}
+	log.Println("Database schema is up to date")
+}
@@ -0,0 +1,69 @@
+package rate_limiter
+
+import (
+	"net"
+	"net/http"
+	"shareit/config"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies (TRUSTED_PROXIES) whose X-Forwarded-For header is believed
+var trustedProxies []*net.IPNet
+
+// InitTrustedProxies takes the reverse proxies in front of the server from cfg
+func InitTrustedProxies(cfg *config.Config) {
+	trustedProxies = cfg.TrustedProxies
+}
+
+func trusted(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address of the client that made the request. X-Forwarded-For is only used when
+// the request came from a trusted proxy, and then read from the right: every proxy appends the
+// address it received the request from, so the first address not belonging to a trusted proxy is
+// the client. Entries further left are set by the client and can be forged.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !trusted(remote) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Garbage in the header; the last address we could trust is the best we know
+			break
+		}
+		client = ip.String()
+		if !trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// ByIP applies the route's rate limit policy per client IP address, for routes without a logged-in
+// user
+func ByIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Allow(w, r, "ip:"+ClientIP(r)) {
+			return
+		}
+		next(w, r)
+	}
+}
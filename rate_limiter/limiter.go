@@ -1,22 +1,108 @@
 package rate_limiter
 
 import (
+	"context"
+	"log"
+	"net/http"
 	"shareit/db"
 	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
-// RateLimit limits the number of requests a user can make per minute
-func RateLimit(userID int) bool {
-    key := "ratelimit_" + strconv.Itoa(userID)
-    count, err := db.RedisClient.Incr(db.Ctx, key).Result()
+// Decision is the outcome of one rate limit check
+type Decision struct {
+	Allowed bool
+	// Limit is the number of requests the policy allows in a burst
+	Limit int
+	// Remaining is how many more requests are allowed right now
+	Remaining int
+	// RetryAfter is how long a rejected request has to wait
+	RetryAfter time.Duration
+	// Reset is how long until the full limit is available again
+	Reset time.Duration
+}
+
+// Limiter decides whether the request identified by key may proceed. Implementations keep their
+// state in Redis and update it atomically, so every server instance shares the same limits.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// Policy is a named limiter. The name namespaces the counters: routes with the same policy name
+// share one budget.
+type Policy struct {
+	Name    string
+	Limiter Limiter
+}
+
+// Policies maps routes to policies. Keys are "METHOD /path/template" for one method or
+// "/path/template" for every method, with the path template as registered with the router.
+type Policies map[string]Policy
+
+var (
+	defaultPolicy = Policy{Name: "default", Limiter: NewSlidingWindowLog(100, time.Minute)}
+	routePolicies = Policies{}
+)
+
+// Configure sets the policy of routes without one of their own and the per-route policies
+func Configure(fallback Policy, routes Policies) {
+	defaultPolicy = fallback
+	routePolicies = routes
+
+	localMu.Lock()
+	localLimiters = map[string]*localLimiter{}
+	localMu.Unlock()
+}
+
+// policyFor picks the most specific policy for a request
+func policyFor(r *http.Request) Policy {
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			path = tpl
+		}
+	}
+	if p, ok := routePolicies[r.Method+" "+path]; ok {
+		return p
+	}
+	if p, ok := routePolicies[path]; ok {
+		return p
+	}
+	return defaultPolicy
+}
+
+// Allow applies the request's policy to subject (e.g. "user:42") and sets the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. Rejected requests get a 429 with Retry-After;
+// the caller must stop when Allow returns false. While Redis is unavailable the policy's in-process
+// fallback limits the request, unless rate limiting fails closed.
+func Allow(w http.ResponseWriter, r *http.Request, subject string) bool {
+	policy := policyFor(r)
+	key := "ratelimit:" + policy.Name + ":" + subject
+	d, err := policy.Limiter.Allow(r.Context(), key)
+	if db.FailsOpen(db.FeatureRateLimit, err) {
+		d, err = fallbackFor(policy).Allow(r.Context(), key)
+	}
     if err != nil {
+		log.Println("Error checking rate limit:", err)
+		http.Error(w, "Rate limiter unavailable", http.StatusServiceUnavailable)
         return false
     }
 
-    if count == 1 {
-        db.RedisClient.Expire(db.Ctx, key, 1*time.Minute)
-    }
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(d.Reset)))
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
 
-    return count <= 100
+// seconds rounds d up to whole seconds, as the headers expect
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
@@ -0,0 +1,102 @@
+package rate_limiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxLocalBuckets bounds the memory of a local limiter; beyond it, buckets that have refilled
+// completely are dropped since they hold no information
+const maxLocalBuckets = 10000
+
+// localLimiter is an in-process token bucket standing in for a Redis limiter while Redis is
+// unavailable. Every instance counts on its own, so the effective limit is multiplied by the
+// number of instances for the duration of the outage.
+type localLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // between two tokens
+	burst    int
+	buckets  map[string]*localBucket
+}
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// newLocalLimiter approximates l in memory: a sliding window of limit per window becomes a bucket
+// of limit tokens refilled over the window
+func newLocalLimiter(l Limiter) *localLimiter {
+	local := &localLimiter{buckets: map[string]*localBucket{}}
+	switch l := l.(type) {
+	case *TokenBucket:
+		local.interval = l.Per / time.Duration(l.Rate)
+		local.burst = l.Burst
+	case *SlidingWindowLog:
+		local.interval = l.Window / time.Duration(l.Limit)
+		local.burst = l.Limit
+	default:
+		local.interval = time.Minute / 100
+		local.burst = 100
+	}
+	return local
+}
+
+func (l *localLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLocalBuckets {
+			l.sweep(now)
+		}
+		b = &localBucket{tokens: float64(l.burst), ts: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.ts = now
+
+	d := Decision{Limit: l.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1 - b.tokens) * float64(l.interval))
+	}
+	d.Remaining = int(math.Floor(b.tokens))
+	d.Reset = time.Duration((float64(l.burst) - b.tokens) * float64(l.interval))
+	return d, nil
+}
+
+func (l *localLimiter) refill(b *localBucket, now time.Time) float64 {
+	return math.Min(float64(l.burst), b.tokens+float64(now.Sub(b.ts))/float64(l.interval))
+}
+
+func (l *localLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	localMu       sync.Mutex
+	localLimiters = map[string]*localLimiter{}
+)
+
+// fallbackFor returns the in-process limiter of a policy, created on first use
+func fallbackFor(policy Policy) *localLimiter {
+	localMu.Lock()
+	defer localMu.Unlock()
+	l, ok := localLimiters[policy.Name]
+	if !ok {
+		l = newLocalLimiter(policy.Limiter)
+		localLimiters[policy.Name] = l
+	}
+	return l
+}
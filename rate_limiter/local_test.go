@@ -0,0 +1,109 @@
+package rate_limiter
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewLocalLimiter(t *testing.T) {
+	// A bucket of rate per period keeps its burst
+	if l := newLocalLimiter(NewTokenBucket(10, time.Second, 20)); l.interval != 100*time.Millisecond || l.burst != 20 {
+		t.Errorf("token bucket: interval = %v, burst = %d", l.interval, l.burst)
+	}
+	// A window of limit requests becomes a bucket of limit tokens refilled over the window
+	if l := newLocalLimiter(NewSlidingWindowLog(5, time.Minute)); l.interval != 12*time.Second || l.burst != 5 {
+		t.Errorf("sliding window: interval = %v, burst = %d", l.interval, l.burst)
+	}
+}
+
+func TestLocalLimiterAllow(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// elapsed backdates the bucket before the final request
+		elapsed       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{"burst used up", 0, false, 0},
+		{"one token refilled", time.Second, true, 0},
+		{"partly refilled", 2500 * time.Millisecond, true, 1},
+		{"refill capped at the burst", time.Hour, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLocalLimiter(NewTokenBucket(1, time.Second, 3))
+			for i := 0; i < 3; i++ {
+				d, _ := l.Allow(ctx, "key")
+				if !d.Allowed || d.Remaining != 2-i || d.Limit != 3 {
+					t.Fatalf("request %d: %+v", i, d)
+				}
+			}
+			l.buckets["key"].ts = l.buckets["key"].ts.Add(-tt.elapsed)
+
+			d, err := l.Allow(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != tt.wantAllowed || d.Remaining != tt.wantRemaining {
+				t.Fatalf("Allow = %+v, want allowed %v with %d remaining", d, tt.wantAllowed, tt.wantRemaining)
+			}
+			if !d.Allowed && (d.RetryAfter <= 0 || d.RetryAfter > time.Second) {
+				t.Errorf("RetryAfter = %v, want at most a second", d.RetryAfter)
+			}
+			if d.Reset <= 0 || d.Reset > 3*time.Second {
+				t.Errorf("Reset = %v, want at most the full refill", d.Reset)
+			}
+		})
+	}
+}
+
+func TestLocalLimiterKeysAreIndependent(t *testing.T) {
+	ctx := context.Background()
+	l := newLocalLimiter(NewSlidingWindowLog(1, time.Minute))
+	if d, _ := l.Allow(ctx, "a"); !d.Allowed {
+		t.Fatal("first request for a rejected")
+	}
+	if d, _ := l.Allow(ctx, "a"); d.Allowed {
+		t.Fatal("second request for a allowed")
+	}
+	if d, _ := l.Allow(ctx, "b"); !d.Allowed {
+		t.Fatal("b limited by requests for a")
+	}
+}
+
+func TestLocalLimiterSweep(t *testing.T) {
+	ctx := context.Background()
+	l := newLocalLimiter(NewTokenBucket(1, time.Second, 2))
+	for i := 0; i < maxLocalBuckets; i++ {
+		key := strconv.Itoa(i)
+		l.Allow(ctx, key)
+		if i%2 == 0 {
+			// Refilled completely, so it holds no information
+			l.buckets[key].ts = l.buckets[key].ts.Add(-time.Minute)
+		}
+	}
+
+	l.Allow(ctx, "new")
+	if got, want := len(l.buckets), maxLocalBuckets/2+1; got != want {
+		t.Fatalf("%d buckets after the sweep, want %d", got, want)
+	}
+	if _, ok := l.buckets["1"]; !ok {
+		t.Error("swept a bucket that had not refilled")
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Error("kept a bucket that had refilled")
+	}
+}
+
+func TestFallbackForReusesPolicyLimiter(t *testing.T) {
+	policy := Policy{Name: "test-fallback", Limiter: NewTokenBucket(1, time.Second, 1)}
+	if fallbackFor(policy) != fallbackFor(policy) {
+		t.Fatal("fallbackFor created a second limiter for the same policy")
+	}
+	if fallbackFor(policy) == fallbackFor(Policy{Name: "test-fallback-other", Limiter: policy.Limiter}) {
+		t.Fatal("two policies share a limiter")
+	}
+}
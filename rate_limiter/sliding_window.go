@@ -0,0 +1,72 @@
+package rate_limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"shareit/db"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// slidingWindowScript keeps one sorted set entry per accepted request, scored by its time in
+// milliseconds. It returns {allowed, remaining, retry after ms, reset ms}. The clock is Redis's,
+// so server instances with drifting clocks still agree.
+var slidingWindowScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, now .. ':' .. ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local reset = 0
+if oldest[2] then reset = tonumber(oldest[2]) + window - now end
+local retry = 0
+if allowed == 0 then retry = reset end
+return {allowed, limit - count, retry, reset}
+`)
+
+// SlidingWindowLog allows Limit requests in any Window long period. Unlike a fixed window counter
+// it does not allow twice the limit around a window boundary, at the cost of one sorted set entry
+// per request.
+type SlidingWindowLog struct {
+	Limit  int
+	Window time.Duration
+}
+
+// NewSlidingWindowLog creates a sliding window log limiter
+func NewSlidingWindowLog(limit int, window time.Duration) *SlidingWindowLog {
+	return &SlidingWindowLog{Limit: limit, Window: window}
+}
+
+// Allow records the request if it fits into the window
+func (l *SlidingWindowLog) Allow(ctx context.Context, key string) (Decision, error) {
+	// Requests within the same millisecond need distinct entries
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+
+	res, err := slidingWindowScript.Run(ctx, db.RedisClient, []string{key},
+		l.Limit, l.Window.Milliseconds(), hex.EncodeToString(nonce)).Int64Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{
+		Allowed:    res[0] == 1,
+		Limit:      l.Limit,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+		Reset:      time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
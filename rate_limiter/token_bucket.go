@@ -0,0 +1,69 @@
+package rate_limiter
+
+import (
+	"context"
+	"shareit/db"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBucketScript refills the bucket for the time since its last use, then takes one token. It
+// returns {allowed, remaining, retry after ms, reset ms}; like the sliding window it uses the
+// Redis clock.
+var tokenBucketScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local capacity = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) / interval)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+local reset = math.ceil((capacity - tokens) * interval)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.max(reset, 1))
+
+local retry = 0
+if allowed == 0 then retry = math.ceil((1 - tokens) * interval) end
+return {allowed, math.floor(tokens), retry, reset}
+`)
+
+// TokenBucket allows bursts of up to Burst requests and Rate requests per Per on average after
+// that, which suits expensive operations such as uploads
+type TokenBucket struct {
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+// NewTokenBucket creates a token bucket limiter refilling rate tokens per per, holding at most burst
+func NewTokenBucket(rate int, per time.Duration, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Per: per, Burst: burst}
+}
+
+// Allow takes a token from the bucket if one is left
+func (l *TokenBucket) Allow(ctx context.Context, key string) (Decision, error) {
+	// Milliseconds between two tokens; fractional values are fine for Lua
+	interval := float64(l.Per.Milliseconds()) / float64(l.Rate)
+
+	res, err := tokenBucketScript.Run(ctx, db.RedisClient, []string{key}, l.Burst, interval).Int64Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{
+		Allowed:    res[0] == 1,
+		Limit:      l.Burst,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+		Reset:      time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
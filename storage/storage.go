@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"shareit/config"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when the requested object does not exist in the backend
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a single stored object
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// Storage is implemented by every backend that file blobs can be persisted to.
+// Keys are backend-neutral, slash separated paths such as "8/report.pdf.enc".
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// ReadAtCloser is an object opened for random access
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// readerAtOpener is implemented by backends with native random access, such as local files
+type readerAtOpener interface {
+	OpenReaderAt(ctx context.Context, key string) (ReadAtCloser, ObjectInfo, error)
+}
+
+// OpenReaderAt opens key for random access. Backends without native support are read through one
+// streaming GetRange that sequential ReadAt calls continue; only seeks open a new one.
+func OpenReaderAt(ctx context.Context, s Storage, key string) (ReadAtCloser, ObjectInfo, error) {
+	if opener, ok := s.(readerAtOpener); ok {
+		return opener.OpenReaderAt(ctx, key)
+	}
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &rangeReaderAt{ctx: ctx, s: s, key: key, size: info.Size}, info, nil
+}
+
+// maxSkip is how far ahead of the open stream a read may start and still continue it; the bytes in
+// between are discarded rather than paying for another request
+const maxSkip = 1 << 20
+
+type rangeReaderAt struct {
+	ctx  context.Context
+	s    Storage
+	key  string
+	size int64
+
+	mu   sync.Mutex
+	body io.ReadCloser // streams the object from pos to the end
+	pos  int64
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	length := int64(len(p))
+	if off+length > r.size {
+		length = r.size - off
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.body != nil && off >= r.pos && off-r.pos <= maxSkip {
+		if _, err := io.CopyN(io.Discard, r.body, off-r.pos); err != nil {
+			r.closeBody()
+		} else {
+			r.pos = off
+		}
+	}
+	if r.body == nil || r.pos != off {
+		r.closeBody()
+		body, err := r.s.GetRange(r.ctx, r.key, off, r.size-off)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.pos = body, off
+	}
+
+	n, err := io.ReadFull(r.body, p[:length])
+	r.pos += int64(n)
+	if err != nil {
+		// A broken stream is reopened by the next read
+		r.closeBody()
+		return n, err
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rangeReaderAt) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+func (r *rangeReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeBody()
+	return nil
+}
+
+// Default is the backend selected by configuration in Connect
+var Default Storage
+
+// Connect initializes the storage backend selected by cfg.StorageBackend ("local" or "s3")
+func Connect(cfg *config.Config) {
+	switch cfg.StorageBackend {
+	case "local":
+		local, err := NewLocal(cfg.StorageLocalDir)
+		if err != nil {
+			log.Fatal("Could not initialize local storage: ", err)
+		}
+		Default = local
+		log.Println("Using local storage at", cfg.StorageLocalDir)
+	case "s3":
+		s3, err := NewS3(S3Config{
+			Endpoint:       cfg.S3Endpoint,
+			Region:         cfg.S3Region,
+			Bucket:         cfg.S3Bucket,
+			AccessKey:      cfg.S3AccessKey,
+			SecretKey:      cfg.S3SecretKey,
+			ForcePathStyle: cfg.S3ForcePathStyle,
+		})
+		if err != nil {
+			log.Fatal("Could not initialize S3 storage: ", err)
+		}
+		Default = s3
+		log.Println("Using S3 storage bucket", s3.cfg.Bucket)
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q", cfg.StorageBackend)
+	}
+}
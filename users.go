@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"shareit/auth"
+	"shareit/db"
+)
+
+// runUsersCommand implements the "shareit users ..." operator commands
+func runUsersCommand(args []string) {
+	if len(args) != 3 || args[0] != "set-role" || !auth.ValidRole(args[2]) {
+		fmt.Fprintln(os.Stderr, "usage: shareit users set-role <email> user|admin|auditor")
+		os.Exit(2)
+	}
+	email, role := args[1], args[2]
+
+	db.ConnectDB(loadConfig(nil))
+	defer db.DB.Close()
+
+	result, err := db.DB.Exec("UPDATE users SET role = ? WHERE email = ?", role, email)
+	if err != nil {
+		log.Fatal("Error updating role: ", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)", email).Scan(&exists)
+		if !exists {
+			log.Fatalf("No user with email %q", email)
+		}
+	}
+	log.Printf("%s is now %s", email, role)
+}